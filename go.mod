@@ -2,4 +2,9 @@ module github.com/shushcli/shush
 
 go 1.14
 
-require github.com/hashicorp/vault v1.6.0
+require (
+	github.com/klauspost/compress v1.11.4
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
+	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf
+)
@@ -0,0 +1,261 @@
+package lib
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFormat is the format directories are archived in before they're encrypted
+const archiveFormat = "tar"
+
+var (
+	errNotArchive  = errors.New("the file isn't an encrypted directory; decrypt it without -extract")
+	errIsDirectory = func(path string) error {
+		return fmt.Errorf("\"%s\" is a directory; use -r to encrypt a whole directory", path)
+	}
+	errNotDirectory = func(path string) error { return fmt.Errorf("\"%s\" is not a directory", path) }
+	errUnsafePath   = func(name string) error {
+		return fmt.Errorf("refusing to extract \"%s\", which is outside of the directory", name)
+	}
+	errUnsafeLink = func(name string, target string) error {
+		return fmt.Errorf("\"%s\" links to \"%s\"; only links to relative paths inside the directory, without "+
+			"\"..\", can be archived", name, target)
+	}
+	errUnsupportedEntry = func(name string) error {
+		return fmt.Errorf("refusing to extract \"%s\", which isn't a file, directory or symlink", name)
+	}
+)
+
+// EncryptDir archives the directory dir and encrypts the archive in one pass, using the key in keyFile, so that the
+// archive is never written to disk. Only files, directories and symlinks are archived.
+func EncryptDir(keyFile string, dir string, opts EncryptOptions) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errNotDirectory(dir)
+	}
+
+	dst := filepath.Clean(dir)
+	if base := filepath.Base(dst); base == "." || base == ".." || base == string(filepath.Separator) {
+		dst, err = filepath.Abs(dst)
+		if err != nil {
+			return err
+		}
+	}
+
+	archive := archiveReader(dir)
+	defer archive.Close()
+
+	header := &encryptHeader{Length: -1, Archive: archiveFormat}
+	return encrypt(keyFile, archive, info, header, dst+encryptExt, opts)
+}
+
+// archiveReader returns a reader of a tar archive of the directory dir, whose entries are named relative to it.
+// Closing it stops the archiving, if it wasn't read to the end.
+func archiveReader(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(dir, file)
+			if err != nil || name == "." {
+				return err
+			}
+			return archiveEntry(tw, file, filepath.ToSlash(name), info)
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// archiveEntry writes the file described by info to tw, as name
+func archiveEntry(tw *tar.Writer, file string, name string, info os.FileInfo) error {
+	link := ""
+	switch mode := info.Mode(); {
+	case mode.IsRegular(), mode.IsDir():
+	case mode&os.ModeSymlink != 0:
+		var err error
+		link, err = os.Readlink(file)
+		if err != nil {
+			return err
+		}
+		// links that couldn't be extracted are caught now, rather than when they're needed
+		if !safeLink(link) {
+			return errUnsafeLink(file, link)
+		}
+	default:
+		fmt.Printf("Skipping %s, which isn't a file, directory or symlink\n", file)
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractArchive unpacks the tar archive in r into the new directory dir. Nothing is written outside of dir: names
+// that are absolute or climb out with "..", writes through symlinks, and symlinks that could point outside of dir are
+// all refused, and existing files are never replaced.
+func extractArchive(r io.Reader, dir string) (err error) {
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if os.IsExist(err) {
+			return errFileExists(dir)
+		}
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// directories get their permissions and times last, once nothing else needs to be written inside them
+	var dirs []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name, err := extractedPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(name, 0700)
+			if os.IsExist(err) {
+				if info, e := os.Lstat(name); e == nil && info.IsDir() {
+					err = nil
+				}
+			}
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			err = extractFile(tr, name, header)
+		case tar.TypeSymlink:
+			if !safeLink(header.Linkname) {
+				return errUnsafeLink(header.Name, header.Linkname)
+			}
+			err = os.Symlink(header.Linkname, name)
+		default:
+			return errUnsupportedEntry(header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		name, _ := extractedPath(dir, dirs[i].Name)
+		if err := os.Chmod(name, os.FileMode(dirs[i].Mode).Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(name, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractFile writes the contents of the current entry of tr to the new file at name
+func extractFile(tr *tar.Reader, name string, header *tar.Header) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return errFileExists(name)
+		}
+		return err
+	}
+
+	_, err = io.Copy(f, tr)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(name, os.FileMode(header.Mode).Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(name, header.ModTime, header.ModTime)
+}
+
+// extractedPath returns where the entry called name is extracted to inside dir. The name has to stay inside dir,
+// and none of the directories on the way to it can be symlinks, which could lead anywhere.
+func extractedPath(dir string, name string) (string, error) {
+	clean := path.Clean(strings.TrimSuffix(name, "/"))
+	if name == "" || path.IsAbs(clean) || clean == "." || hasDotDot(clean) || strings.Contains(clean, `\`) {
+		return "", errUnsafePath(name)
+	}
+
+	parts := strings.Split(clean, "/")
+	parent := dir
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", errUnsafePath(name)
+		}
+	}
+
+	return filepath.Join(parent, parts[len(parts)-1]), nil
+}
+
+// safeLink reports whether a symlink to target stays inside the directory it's extracted into. Targets are relative
+// and can't contain "..", so they can only lead further into the directory, even through other links.
+func safeLink(target string) bool {
+	return target != "" && !path.IsAbs(target) && !filepath.IsAbs(target) && !hasDotDot(filepath.ToSlash(target))
+}
+
+// hasDotDot reports whether any part of the slash separated name is ".."
+func hasDotDot(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
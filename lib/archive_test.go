@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestDir fills the directory secrets with a few files, a subdirectory and a symlink
+func writeTestDir(t *testing.T, big []byte) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Join("secrets", "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"notes.txt":                       []byte("top secret"),
+		filepath.Join("sub", "big.bin"):   big,
+		filepath.Join("sub", "empty.txt"): {},
+		filepath.Join("sub", "run.sh"):    []byte("#!/bin/sh\n"),
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join("secrets", name), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Chmod(filepath.Join("secrets", "sub", "run.sh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join("sub", "big.bin"), filepath.Join("secrets", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptDir(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 3*streamChunk+100)
+	rand.Read(big)
+
+	for _, compression := range []string{"", "gzip"} {
+		deleteTestFiles()
+		Gen("test.key", GenOptions{})
+		writeTestDir(t, big)
+
+		err = Encrypt("test.key", "secrets", EncryptOptions{})
+		if err == nil {
+			t.Fatal("encrypted a directory without -r")
+		}
+
+		err = EncryptDir("test.key", "secrets/", EncryptOptions{Compression: compression, Parity: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the directory is still there, so extracting over it fails, which isn't mistaken for damage
+		err = Decrypt("test.key", "secrets.shush", DecryptOptions{Extract: true})
+		if err == nil || err.Error() != errFileExists("secrets").Error() {
+			t.Fatal("expected extracting over an existing directory to fail, got", err)
+		}
+
+		os.RemoveAll("secrets")
+		err = Decrypt("test.key", "secrets.shush", DecryptOptions{Extract: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join("secrets", "link"))
+		if err != nil || !bytes.Equal(data, big) {
+			t.Fatalf("the link doesn't lead to the big file: %v", err)
+		}
+		data, err = ioutil.ReadFile(filepath.Join("secrets", "notes.txt"))
+		if err != nil || string(data) != "top secret" {
+			t.Fatalf("notes.txt is %q: %v", data, err)
+		}
+		info, err := os.Stat(filepath.Join("secrets", "sub", "run.sh"))
+		if err != nil || info.Mode().Perm() != 0700 {
+			t.Fatalf("run.sh wasn't restored with its permissions: %v", err)
+		}
+
+		// without -extract, the archive is written out
+		os.RemoveAll("secrets")
+		err = Decrypt("test.key", "secrets.shush", DecryptOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := os.Open("secrets.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := map[string]bool{}
+		tr := tar.NewReader(archive)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			names[header.Name] = true
+		}
+		archive.Close()
+		for _, name := range []string{"notes.txt", "sub/", "sub/big.bin", "sub/empty.txt", "sub/run.sh", "link"} {
+			if !names[name] {
+				t.Fatalf("the archive is missing %s: %v", name, names)
+			}
+		}
+
+		// ranges of an uncompressed archive can still be decrypted
+		if compression == "" {
+			e, err := OpenEncrypted("test.key", "secrets.shush")
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, _ := os.Stat("secrets.tar")
+			if e.Size() != info.Size() {
+				t.Fatalf("size is %d, expected %d", e.Size(), info.Size())
+			}
+			e.Close()
+		} else if err := DecryptRange("test.key", "secrets.shush", 0, 10, ioutil.Discard); err == nil {
+			t.Fatal("decrypted a range of a compressed file")
+		}
+	}
+}
+
+func TestEncryptDirTruncated(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 3*streamChunk+100)
+	rand.Read(big)
+	writeTestDir(t, big)
+
+	err = EncryptDir("test.key", "secrets", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll("secrets")
+
+	// cutting off whole chunks leaves a stream that looks complete, except that its last chunk isn't marked as last
+	sealed, err := ioutil.ReadFile("secrets.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, ad, err := readEncryptHeader(bufio.NewReader(bytes.NewReader(sealed)))
+	if err != nil || header.Length != -1 {
+		t.Fatalf("expected a stream of unknown length: %v", err)
+	}
+	start := len(ad) + nonceSize - streamCounter
+	chunks := (len(sealed) - start + streamChunk + tagSize - 1) / (streamChunk + tagSize)
+	err = ioutil.WriteFile("secrets.shush", sealed[:start+(chunks-1)*(streamChunk+tagSize)], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt("test.key", "secrets.shush", DecryptOptions{Extract: true})
+	if err == nil {
+		t.Fatal("extracted a truncated archive")
+	}
+	if _, err := os.Stat("secrets"); !os.IsNotExist(err) {
+		t.Fatal("a truncated archive was left extracted")
+	}
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+
+	type entry struct {
+		name, link string
+		kind       byte
+	}
+
+	cases := map[string][]entry{
+		"parent":         {{name: "../evil", kind: tar.TypeReg}},
+		"nested parent":  {{name: "sub/../../evil", kind: tar.TypeReg}},
+		"absolute":       {{name: "/tmp/evil", kind: tar.TypeReg}},
+		"absolute link":  {{name: "evil", link: "/etc/passwd", kind: tar.TypeSymlink}},
+		"escaping link":  {{name: "evil", link: "../evil", kind: tar.TypeSymlink}},
+		"link to root":   {{name: "l", link: ".", kind: tar.TypeSymlink}, {name: "l/evil", kind: tar.TypeReg}},
+		"through a link": {{name: "sub/", kind: tar.TypeDir}, {name: "l", link: "sub", kind: tar.TypeSymlink}, {name: "l/evil", kind: tar.TypeReg}},
+		"over a link":    {{name: "sub/", kind: tar.TypeDir}, {name: "l", link: "sub", kind: tar.TypeSymlink}, {name: "l", kind: tar.TypeReg}},
+		"duplicate":      {{name: "a", kind: tar.TypeReg}, {name: "a", kind: tar.TypeReg}},
+		"hard link":      {{name: "a", kind: tar.TypeReg}, {name: "b", link: "a", kind: tar.TypeLink}},
+		"device":         {{name: "null", kind: tar.TypeChar}},
+		"empty name":     {{name: "", kind: tar.TypeReg}},
+	}
+
+	for name, entries := range cases {
+		deleteTestFiles()
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, e := range entries {
+			err := tw.WriteHeader(&tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.kind, Mode: 0600})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+
+		err := extractArchive(&buf, "secrets")
+		if err == nil {
+			t.Fatalf("%s: extracted an unsafe archive", name)
+		}
+		if _, err := os.Lstat("secrets"); !os.IsNotExist(err) {
+			t.Fatalf("%s: left a partly extracted directory", name)
+		}
+		if _, err := os.Lstat("evil"); !os.IsNotExist(err) {
+			t.Fatalf("%s: wrote outside of the directory", name)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// Files are written alongside where they belong, under a temporary name, and only put in place once all of them is
+// safely on disk, so a crash or a yanked drive leaves either the whole file or none of it. New files are linked into
+// place, which fails if anything got there first, so nothing is ever overwritten. Filesystems without hard links,
+// like the FAT on most flash drives, fall back to checking for the file and renaming over it, which leaves a small
+// window for a file to appear in between. A crash can leave a temporary file behind, named like .name.1a2b3c.tmp.
+
+// newFile is a file being written, which doesn't appear at its path until it's committed
+type newFile struct {
+	*os.File
+	path string
+	done bool
+	// replace is set for files that take the place of the file at path, rather than only being written if it's new
+	replace bool
+}
+
+// safeCreate starts writing a new file at path, and throws errors if the file already exists. The file has to be
+// committed or aborted.
+func safeCreate(path string, perms os.FileMode) (*newFile, error) {
+	// finding out now saves doing all of the work first, but the check that counts happens on commit
+	if _, err := os.Lstat(path); err == nil {
+		return nil, errFileExists(path)
+	}
+
+	file, err := createTemp(path, perms)
+	if err != nil {
+		return nil, err
+	}
+	return &newFile{File: file, path: path}, nil
+}
+
+// replaceCreate starts writing a file that replaces the one at path once it's committed. The file has to be committed
+// or aborted.
+func replaceCreate(path string, perms os.FileMode) (*newFile, error) {
+	file, err := createTemp(path, perms)
+	if err != nil {
+		return nil, err
+	}
+	return &newFile{File: file, path: path, replace: true}, nil
+}
+
+// commit flushes the file to disk, and puts it in place
+func (f *newFile) commit() error {
+	err := f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil && f.replace {
+		err = os.Rename(f.Name(), f.path)
+	} else if err == nil {
+		err = publish(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	f.done = true
+	syncDir(f.path)
+	return nil
+}
+
+// abort throws away a file that couldn't be finished. It does nothing once the file is committed.
+func (f *newFile) abort() {
+	if f.done {
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// safeWrite writes data to a new file at path, and throws errors if the file already exists
+func safeWrite(path string, data []byte, perms os.FileMode) error {
+	f, err := safeCreate(path, perms)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
+
+// replaceFile overwrites the file at path with data, by writing it alongside and renaming it into place
+func replaceFile(path string, data []byte, perms os.FileMode) error {
+	f, err := replaceCreate(path, perms)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
+
+// createTemp creates a new file with a random name next to path
+func createTemp(path string, perms os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	for {
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, "."+base+"."+hex.EncodeToString(suffix)+".tmp")
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perms)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+}
+
+// publish moves the finished file at tmp to path, unless something is already there
+func publish(tmp string, path string) error {
+	err := os.Link(tmp, path)
+	if err == nil {
+		// the file is in place, so a stray link to it is harmless
+		os.Remove(tmp)
+		return nil
+	}
+	if os.IsExist(err) {
+		return errFileExists(path)
+	}
+
+	// without hard links, the best we can do is to check first
+	if _, err := os.Lstat(path); err == nil {
+		return errFileExists(path)
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncDir flushes the directory holding path, so that the file's name is on disk as well as its contents. Not every
+// system can sync a directory, so this is done where it can be.
+func syncDir(path string) {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
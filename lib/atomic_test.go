@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeWrite(t *testing.T) {
+	defer deleteTestFiles()
+
+	if err := safeWrite("data.txt", []byte(testData), 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected permissions 0600, got %v", info.Mode().Perm())
+	}
+
+	// existing files are never overwritten
+	if err := safeWrite("data.txt", []byte("something else"), 0600); err == nil {
+		t.Fatal("expected writing over an existing file to fail")
+	}
+	contents, _ := ioutil.ReadFile("data.txt")
+	if string(contents) != testData {
+		t.Fatalf("the existing file was changed to %q", contents)
+	}
+
+	if err := replaceFile("data.txt", []byte("something else"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	contents, _ = ioutil.ReadFile("data.txt")
+	if string(contents) != "something else" {
+		t.Fatalf("expected the file to be replaced, got %q", contents)
+	}
+	expectNoTemporaryFiles(t)
+}
+
+func TestSafeCreate(t *testing.T) {
+	defer deleteTestFiles()
+
+	// nothing appears until the file is committed
+	f, err := safeCreate("data.txt", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("data.txt"); !os.IsNotExist(err) {
+		t.Fatal("the file appeared before it was committed")
+	}
+	if err := f.commit(); err != nil {
+		t.Fatal(err)
+	}
+	f.abort()
+	contents, _ := ioutil.ReadFile("data.txt")
+	if string(contents) != testData {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+
+	// aborted files leave nothing behind
+	f, err = safeCreate("data.txt.shush", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(testData))
+	f.abort()
+	if _, err := os.Stat("data.txt.shush"); !os.IsNotExist(err) {
+		t.Fatal("an aborted file was put in place")
+	}
+
+	// a file that turns up while another is being written isn't overwritten
+	f, err = safeCreate("data.txt.shush", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("data.txt.shush", []byte("got here first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.commit(); err == nil {
+		t.Fatal("expected committing over an existing file to fail")
+	}
+	contents, _ = ioutil.ReadFile("data.txt.shush")
+	if string(contents) != "got here first" {
+		t.Fatalf("the existing file was changed to %q", contents)
+	}
+	expectNoTemporaryFiles(t)
+}
+
+// expectNoTemporaryFiles fails the test if a temporary file was left behind
+func expectNoTemporaryFiles(t *testing.T) {
+	t.Helper()
+
+	tmp, _ := filepath.Glob(".*.tmp")
+	if len(tmp) > 0 {
+		t.Fatalf("temporary files were left behind: %v", tmp)
+	}
+}
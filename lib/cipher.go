@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// saltSize is the length of the random salt each file's key is derived with
+	saltSize     = 32
+	fileInfo     = "shush file key"
+	metadataInfo = "shush file metadata"
+	keyIDInfo    = "shush key id"
+)
+
+var (
+	errUnknownCipher = func(name string) error { return fmt.Errorf("unknown cipher \"%s\"", name) }
+	errWrongKey      = func(want string, got string) error {
+		return fmt.Errorf("this file needs key %s, but key %s was supplied", want, got)
+	}
+)
+
+// Ciphers lists the names of the ciphers that files can be encrypted with. AES-256-GCM is used by default, and
+// XChaCha20-Poly1305 is faster on machines without AES instructions.
+var Ciphers = []string{"aes256gcm", "xchacha20poly1305"}
+
+// newCipher returns the cipher recorded in a file header, using key. Files without one use AES-256-GCM.
+func newCipher(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case "", "aes256gcm":
+		return newGCM(key)
+	case "xchacha20poly1305":
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, errUnknownCipher(name)
+	}
+}
+
+// fileCipher returns the cipher that the file with header was sealed with, after checking that the master key is the
+// one the file was encrypted with. Files from before shush recorded key IDs can only fail to decrypt.
+func fileCipher(master []byte, header *encryptHeader) (cipher.AEAD, error) {
+	if header.KeyID != "" {
+		id, err := keyID(master)
+		if err != nil {
+			return nil, err
+		}
+		if id != header.KeyID {
+			return nil, errWrongKey(header.KeyID, id)
+		}
+	}
+
+	key, err := fileKey(master, header.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newCipher(header.Cipher, key)
+	if len(header.Salt) > 0 {
+		// the cipher keeps a copy of the key, but the derived key itself is no longer needed
+		wipe(key)
+	}
+	return aead, err
+}
+
+// fileKey derives the key a file is sealed with from the master key and the file's salt, so that every file gets a
+// key of its own, and the master key never runs out of nonces. Files without a salt were sealed with the master key.
+func fileKey(key []byte, salt []byte) ([]byte, error) {
+	if len(salt) == 0 {
+		return key, nil
+	}
+
+	return deriveKey(key, salt, fileInfo)
+}
+
+// deriveKey derives a key for one purpose, named by info, from the master key and a file's salt
+func deriveKey(key []byte, salt []byte, info string) ([]byte, error) {
+	out := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(info)), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// keyID returns a short name for a key, like 7F3A-91C2, which is the same every time but reveals nothing about the
+// key
+func keyID(key []byte) (string, error) {
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(keyIDInfo)), id); err != nil {
+		return "", err
+	}
+
+	s := strings.ToUpper(hex.EncodeToString(id))
+	return s[:4] + "-" + s[4:], nil
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+var errCompactPolicy = errors.New("compact shards can't be combined with a policy")
+
+// Compact sets use Krawczyk's "secret sharing made short". The secret is encrypted with a random key, the ciphertext
+// is spread over the shares with Rabin's information dispersal, and only the key is shared with shamir. Each share is
+// about len(secret)/threshold long, instead of as long as the secret.
+//
+// The ciphertext is cut into blocks of threshold elements, and each block is used as the coefficients of a
+// polynomial. A share holds its shamir share of the key, followed by the value of every block's polynomial at its
+// x-coordinate: {y1, .., yK, c1, .., cM}. Since both halves are points on polynomials of the same degree, extending
+// the set works exactly like it does for ordinary shares. Shards written before shush streamed held the key after
+// the ciphertext, which is sealed as one piece instead of in chunks.
+
+// disperse returns each share's part of ciphertext, which must be a whole number of blocks long
+func disperse(f field, ciphertext []byte, xs []uint32, threshold int) [][]byte {
+	blocks := len(ciphertext) / (threshold * f.size())
+	shares := make([][]byte, len(xs))
+	for i := range shares {
+		shares[i] = make([]byte, blocks*f.size())
+	}
+
+	p := make(polynomial, threshold)
+	for b := 0; b < blocks; b++ {
+		for k := range p {
+			p[k] = getSymbol(f, ciphertext, b*threshold+k)
+		}
+		for i, x := range xs {
+			putSymbol(f, shares[i], b, p.evaluate(f, x))
+		}
+	}
+
+	return shares
+}
+
+// gather reverses disperse, given exactly a threshold of the shares and the lagrange basis of their x-coordinates
+func gather(f field, basis []polynomial, shares [][]byte) []byte {
+	threshold := len(shares)
+	blocks := len(shares[0]) / f.size()
+	ciphertext := make([]byte, blocks*threshold*f.size())
+	ys := make([]uint32, threshold)
+	for b := 0; b < blocks; b++ {
+		for i, s := range shares {
+			ys[i] = getSymbol(f, s, b)
+		}
+		for k, c := range interpolate(f, basis, ys) {
+			putSymbol(f, ciphertext, b*threshold+k, c)
+		}
+	}
+	return ciphertext
+}
+
+// newGCM returns an AES-GCM cipher for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var errUnknownCompression = func(name string) error {
+	return fmt.Errorf("unknown compression \"%s\"", name)
+}
+
+// Compressions lists the names of the compressions a file can be compressed with before it's encrypted. zstd is
+// faster than gzip, and usually smaller.
+var Compressions = []string{"zstd", "gzip"}
+
+// Encrypted data looks random, so it can't be compressed afterwards. Compressing first leaks a little about the
+// plaintext through the length of the file, which matters for secrets that an attacker can partly choose, but not
+// for backups.
+
+// newCompressor returns a writer that compresses to w with the named compression
+func newCompressor(name string, w io.Writer) (io.WriteCloser, error) {
+	switch name {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, errUnknownCompression(name)
+	}
+}
+
+// compressReader returns a reader of r compressed with the named compression. Closing it stops the compression, if
+// it wasn't read to the end.
+func compressReader(name string, r io.Reader) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	zw, err := newCompressor(name, pw)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		_, err := io.Copy(zw, r)
+		if e := zw.Close(); err == nil {
+			err = e
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// decompressReader returns a reader of r decompressed with the named compression. Files that weren't compressed
+// have no name, and are read as they are.
+func decompressReader(name string, r io.Reader) (io.ReadCloser, error) {
+	switch name {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	default:
+		return nil, errUnknownCompression(name)
+	}
+}
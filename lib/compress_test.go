@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// something like a database dump
+	var original bytes.Buffer
+	for i := 0; original.Len() < 4*streamChunk; i++ {
+		fmt.Fprintf(&original, "INSERT INTO accounts VALUES (%d, 'user%d', 'user%d@example.com');\n", i, i, i)
+	}
+
+	for _, compression := range Compressions {
+		err = ioutil.WriteFile("data.txt", original.Bytes(), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Encrypt("test.key", "data.txt", EncryptOptions{Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove("data.txt")
+
+		info, err := os.Stat("data.txt.shush")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > int64(original.Len()/3) {
+			t.Fatalf("%s: %d bytes compressed to %d", compression, original.Len(), info.Size())
+		}
+
+		err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := ioutil.ReadFile("data.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, original.Bytes()) {
+			t.Fatalf("%s: the decrypted file doesn't match", compression)
+		}
+		os.Remove("data.txt.shush")
+	}
+
+	err = Encrypt("test.key", "data.txt", EncryptOptions{Compression: "lzma"})
+	if err == nil {
+		t.Fatal("encrypted with an unknown compression")
+	}
+	if _, err := os.Stat("data.txt.shush"); !os.IsNotExist(err) {
+		t.Fatal("left an encrypted file behind")
+	}
+}
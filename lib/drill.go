@@ -0,0 +1,324 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	drillVersion = 1
+	drillInfo    = "shush drill signing key"
+)
+
+var (
+	errDrillNotKey = errors.New("drills recover a key in memory, but these shards hold something else; " +
+		"use verify-set instead")
+	errUnexpectedKey = func(got string, want string) error {
+		return fmt.Errorf("the shards hold key %s, not %s", got, want)
+	}
+	errInvalidReport    = errors.New("the report is not a valid drill report")
+	errReportSignature  = errors.New("the report's signature doesn't match; it was changed after it was signed")
+	errInvalidSigner    = errors.New("the signing key should be the base64 public key from an earlier report")
+	errUnexpectedSigner = func(got string, want string) error {
+		return fmt.Errorf("the report was signed by %s, not %s; it wasn't signed by whoever recovered the key "+
+			"before", got, want)
+	}
+)
+
+// DrillOptions describes a recovery drill
+type DrillOptions struct {
+	// Shards are the shard files to recover the key from
+	Shards []string
+	// KeyID is the ID of the key the shards should hold, if it's known
+	KeyID string
+	// Payload is an encrypted file to test-decrypt with the recovered key
+	Payload string
+	// Report is where to write the signed report
+	Report string
+}
+
+// DrillReport is the signed record of a recovery drill. It's signed with an ed25519 key derived from the recovered
+// key, so the same signing key shows up in every report for a set, and only someone who recovered the key could have
+// signed it.
+type DrillReport struct {
+	Version   int          `json:"version"`
+	Date      time.Time    `json:"date"`
+	Set       string       `json:"set"`
+	Threshold int          `json:"threshold"`
+	Shards    []DrillShard `json:"shards"`
+	KeyID     string       `json:"keyid"`
+	Payload   string       `json:"payload,omitempty"`
+	// Result is "pass" if the key was recovered and the payload decrypted, and "fail" with the reason otherwise
+	Result    string `json:"result"`
+	Reason    string `json:"reason,omitempty"`
+	PublicKey []byte `json:"publickey"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// CheckOptions describes who a drill report should have been signed by. Without either, a report can only be checked
+// for changes since it was signed, since anyone can sign a report with a key of their own.
+type CheckOptions struct {
+	// Signer is the base64 public key that signed earlier reports for the set
+	Signer string
+	// Against is an earlier report for the set, which the report should be signed by the same key as
+	Against string
+}
+
+// DrillShard is a shard that took part in a drill
+type DrillShard struct {
+	Index  int    `json:"index"`
+	Holder string `json:"holder,omitempty"`
+}
+
+// Drill recovers a key from its shards in memory, checks it against the digest recorded in the set, test-decrypts a
+// payload with it, and writes a signed report of how it went. Nothing secret is written to disk. An error is returned
+// if no report could be signed, which needs the key.
+func Drill(opts DrillOptions) (*DrillReport, error) {
+	step := 1
+	fmt.Printf("Step %d: recovering the key from %d shards\n", step, len(opts.Shards))
+	masterKey, report, expected, err := drillKey(opts.Shards)
+	if err != nil {
+		return nil, err
+	}
+	defer masterKey.release()
+	key := masterKey.bytes()
+
+	report.KeyID, err = keyID(key)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Recovered key %s, which matches the digest recorded in the set\n\n", report.KeyID)
+
+	// the key ID recorded in the shards says which key they should hold
+	want := opts.KeyID
+	if want == "" {
+		want = expected
+	}
+
+	report.Result = "pass"
+	if want != "" {
+		step++
+		fmt.Printf("Step %d: checking that the key is %s\n", step, want)
+		if want != report.KeyID {
+			report.Result = "fail"
+			report.Reason = errUnexpectedKey(report.KeyID, want).Error()
+		}
+		fmt.Printf("Result: %s\n\n", report.Result)
+	}
+
+	if opts.Payload != "" && report.Result == "pass" {
+		step++
+		fmt.Printf("Step %d: test-decrypting %s, without writing the plaintext\n", step, opts.Payload)
+		report.Payload = opts.Payload
+		if err := verifyEncrypted(key, opts.Payload); err != nil {
+			report.Result = "fail"
+			report.Reason = err.Error()
+		}
+		fmt.Printf("Result: %s\n\n", report.Result)
+	}
+
+	if err := signReport(key, report); err != nil {
+		return nil, err
+	}
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	dst := opts.Report
+	if dst == "" {
+		dst = fmt.Sprintf("shush-drill-%s-%s.json", report.Set, report.Date.Format("2006-01-02"))
+	}
+	if err := safeWrite(dst, append(contents, '\n'), 0644); err != nil {
+		return nil, err
+	}
+
+	if report.Result == "pass" {
+		fmt.Printf("The drill passed. Wrote the signed report to %s\n", dst)
+	} else {
+		fmt.Printf("The drill failed: %s\nWrote the signed report to %s\n", report.Reason, dst)
+	}
+	return report, nil
+}
+
+// drillKey recovers the key in the shards, and starts a report of the set and shards it came from. It also returns
+// the key ID recorded in the shards, if there is one.
+func drillKey(files []string) (*secureBuffer, *DrillReport, string, error) {
+	shards, err := openShards(files)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer closeShards(shards)
+
+	h := shards[0].header
+	if h == nil || len(h.Digest) == 0 {
+		return nil, nil, "", errNoDigest
+	}
+	// the shards hold a key file, which is much smaller than this
+	if h.Length > keyFileLimit {
+		return nil, nil, "", errDrillNotKey
+	}
+
+	secret, _, err := combineShards(files, shards)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	contents, err := readSecret(secret, h.Length)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer contents.release()
+	key, err := parseKey(contents.bytes())
+	if err != nil {
+		return nil, nil, "", errDrillNotKey
+	}
+
+	report := &DrillReport{
+		Version:   drillVersion,
+		Date:      time.Now().UTC().Truncate(time.Second),
+		Set:       h.Set,
+		Threshold: h.Threshold,
+	}
+	if h.Policy != nil {
+		report.Threshold = h.Policy.Threshold
+	}
+	for _, s := range shards {
+		if s.header != nil {
+			report.Shards = append(report.Shards, DrillShard{Index: s.header.Index, Holder: s.header.Holder})
+		}
+	}
+	return key, report, h.KeyID, nil
+}
+
+// drillSigner derives the key that signs drill reports from the recovered key
+func drillSigner(key []byte) (ed25519.PrivateKey, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	defer wipe(seed)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(drillInfo)), seed); err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signReport signs the report, which covers every field but the signature
+func signReport(key []byte, report *DrillReport) error {
+	signer, err := drillSigner(key)
+	if err != nil {
+		return err
+	}
+	defer wipe(signer)
+
+	report.PublicKey = signer.Public().(ed25519.PublicKey)
+	report.Signature = nil
+	signed, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	report.Signature = ed25519.Sign(signer, signed)
+	return nil
+}
+
+// CheckReport checks the signature on a drill report, and prints it. A valid signature only shows that the report
+// came from whoever holds the signing key, so the signing key is checked against the one from earlier drills of the
+// set, given in opts.
+func CheckReport(path string, opts CheckOptions) (*DrillReport, error) {
+	report, err := readReport(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := base64.StdEncoding.EncodeToString(report.PublicKey)
+	var expected []string
+	if opts.Signer != "" {
+		key, err := base64.StdEncoding.DecodeString(opts.Signer)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errInvalidSigner
+		}
+		expected = append(expected, base64.StdEncoding.EncodeToString(key))
+	}
+	if opts.Against != "" {
+		earlier, err := readReport(opts.Against)
+		if err != nil {
+			return nil, err
+		}
+		expected = append(expected, base64.StdEncoding.EncodeToString(earlier.PublicKey))
+	}
+	for _, want := range expected {
+		if signer != want {
+			return nil, errUnexpectedSigner(signer, want)
+		}
+	}
+
+	var shards bytes.Buffer
+	for i, s := range report.Shards {
+		if i > 0 {
+			shards.WriteString(", ")
+		}
+		fmt.Fprint(&shards, s.Index)
+		if s.Holder != "" {
+			fmt.Fprintf(&shards, " (%s)", s.Holder)
+		}
+	}
+
+	fmt.Printf("The signature on %s is valid\n", path)
+	fmt.Printf("  Date:         %s\n", report.Date.Format(time.RFC3339))
+	fmt.Printf("  Set:          %s\n", report.Set)
+	fmt.Printf("  Shards:       %s\n", shards.String())
+	fmt.Printf("  Key ID:       %s\n", report.KeyID)
+	if report.Payload != "" {
+		fmt.Printf("  Payload:      %s\n", report.Payload)
+	}
+	if report.Reason != "" {
+		fmt.Printf("  Result:       %s (%s)\n", report.Result, report.Reason)
+	} else {
+		fmt.Printf("  Result:       %s\n", report.Result)
+	}
+	fmt.Printf("  Signing key:  %s\n", signer)
+
+	if len(expected) == 0 {
+		fmt.Println("\nWarning: anyone can sign a report with a key of their own. Without -signer or -against, this " +
+			"only shows that the report wasn't changed after it was signed, not that it was signed by whoever " +
+			"recovered the key.")
+	} else {
+		fmt.Println("  The signing key matches earlier drills of the set")
+	}
+	return report, nil
+}
+
+// readReport reads the drill report in path, and checks its signature against the key it was signed with
+func readReport(path string) (*DrillReport, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DrillReport{}
+	if err := json.Unmarshal(contents, report); err != nil {
+		return nil, errInvalidReport
+	}
+	if report.Version != drillVersion || len(report.PublicKey) != ed25519.PublicKeySize {
+		return nil, errInvalidReport
+	}
+
+	signature := report.Signature
+	report.Signature = nil
+	signed, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	report.Signature = signature
+	if !ed25519.Verify(report.PublicKey, signed, signature) {
+		return nil, errReportSignature
+	}
+	return report, nil
+}
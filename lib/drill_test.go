@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDrill(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testKey(t, "test.key")
+	id, err := keyID(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	err = Split("test.key", 5, 3, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("test.key")
+
+	shards := []string{"test.key.shard4", "test.key.shard1", "test.key.shard2"}
+	report, err := Drill(DrillOptions{Shards: shards, KeyID: id, Payload: "data.txt.shush", Report: "drill.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Result != "pass" || report.KeyID != id || len(report.Shards) != 3 || report.Shards[0].Index != 4 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, f := range []string{"test.key", "data.txt"} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("the drill wrote %s", f)
+		}
+	}
+
+	checked, err := CheckReport("drill.json", CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked.Result != "pass" || string(checked.PublicKey) != string(report.PublicKey) {
+		t.Fatalf("the checked report doesn't match %+v", checked)
+	}
+	signer := base64.StdEncoding.EncodeToString(report.PublicKey)
+	if _, err := CheckReport("drill.json", CheckOptions{Signer: signer}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a report signed by a key of someone else's is only caught against the expected signer
+	forged := *report
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	forged.PublicKey = other.Public().(ed25519.PublicKey)
+	forged.Signature = nil
+	signed, _ := json.Marshal(&forged)
+	forged.Signature = ed25519.Sign(other, signed)
+	contents, _ := json.Marshal(&forged)
+	ioutil.WriteFile("forged.json", contents, 0644)
+	defer os.Remove("forged.json")
+	if _, err := CheckReport("forged.json", CheckOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckReport("forged.json", CheckOptions{Signer: signer}); err == nil {
+		t.Fatal("accepted a report signed by the wrong key")
+	}
+	if _, err := CheckReport("forged.json", CheckOptions{Against: "drill.json"}); err == nil {
+		t.Fatal("accepted a report signed by a different key than the earlier report")
+	}
+	if _, err := CheckReport("drill.json", CheckOptions{Signer: "not a key"}); err != errInvalidSigner {
+		t.Fatal("expected an invalid signer, got", err)
+	}
+
+	// changing anything breaks the signature
+	var fields map[string]interface{}
+	contents, _ = ioutil.ReadFile("drill.json")
+	json.Unmarshal(contents, &fields)
+	fields["result"] = "fail"
+	contents, _ = json.Marshal(fields)
+	ioutil.WriteFile("drill.json", contents, 0644)
+	if _, err := CheckReport("drill.json", CheckOptions{}); err != errReportSignature {
+		t.Fatal("expected a bad signature, got", err)
+	}
+	os.Remove("drill.json")
+
+	// the wrong key ID is recorded as a failure, signed by the same key
+	report2, err := Drill(DrillOptions{Shards: shards, KeyID: "0000-0000", Report: "drill.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report2.Result != "fail" || string(report2.PublicKey) != string(report.PublicKey) {
+		t.Fatalf("unexpected report %+v", report2)
+	}
+	os.Remove("drill.json")
+
+	// so is a payload encrypted with some other key
+	Gen("new.key", GenOptions{})
+	ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	os.Remove("data.txt.shush")
+	Encrypt("new.key", "data.txt", EncryptOptions{})
+	report3, err := Drill(DrillOptions{Shards: shards, Payload: "data.txt.shush", Report: "drill.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report3.Result != "fail" || report3.Reason == "" {
+		t.Fatalf("unexpected report %+v", report3)
+	}
+}
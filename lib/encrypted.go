@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	errNegativeOffset   = errors.New("negative offset")
+	errLegacyRange      = errors.New("files encrypted by older versions of shush can only be decrypted in full")
+	errCompressedRange  = errors.New("compressed files can only be decrypted in full")
+	errRangeOutOfBounds = func(size int64) error {
+		return fmt.Errorf("the range goes past the end of the file, which is %d bytes", size)
+	}
+)
+
+// EncryptedFile is an open file written by Encrypt. Since the file is sealed in chunks, any range of it can be
+// decrypted by reading and opening just the chunks it covers.
+type EncryptedFile struct {
+	file   *os.File
+	aead   cipher.AEAD
+	header *encryptHeader
+	length int64
+	ad     []byte
+	prefix []byte
+	// start is the offset of the first chunk in the file
+	start int64
+
+	// the last chunk opened is kept, since reads rarely line up with chunks
+	mu     sync.Mutex
+	cached int64
+	last   []byte
+}
+
+// OpenEncrypted opens the encrypted file at path, using the key in keyFile
+func OpenEncrypted(keyFile string, path string) (*EncryptedFile, error) {
+	key, err := readKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer key.release()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := openEncrypted(key.bytes(), file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// openEncrypted reads the header and nonce prefix of an encrypted file
+func openEncrypted(key []byte, file *os.File) (*EncryptedFile, error) {
+	header, ad, err := readEncryptHeader(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, errLegacyRange
+	}
+	if header.Compression != "" {
+		return nil, errCompressedRange
+	}
+
+	aead, err := fileCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, prefixSize(aead))
+	if _, err := file.ReadAt(prefix, int64(len(ad))); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	// the length of a stream isn't recorded, but follows from the length of the file
+	length := header.Length
+	if length < 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		length = openedLength(aead, info.Size()-int64(len(ad)))
+		if length < 0 {
+			return nil, errTruncated
+		}
+	}
+
+	return &EncryptedFile{
+		file:   file,
+		aead:   aead,
+		header: header,
+		length: length,
+		ad:     ad,
+		prefix: prefix,
+		start:  int64(len(ad) + len(prefix)),
+		cached: -1,
+	}, nil
+}
+
+// Size returns the length of the decrypted file
+func (e *EncryptedFile) Size() int64 {
+	return e.length
+}
+
+// ReadAt decrypts len(p) bytes starting at off, following the rules of io.ReaderAt
+func (e *EncryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := 0
+	for n < len(p) && off+int64(n) < e.length {
+		pos := off + int64(n)
+		chunk, err := e.chunk(pos / streamChunk)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], chunk[pos%streamChunk:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunk reads and opens chunk i
+func (e *EncryptedFile) chunk(i int64) ([]byte, error) {
+	if i == e.cached {
+		return e.last, nil
+	}
+
+	chunks := streamChunks(e.length)
+	size := e.length - i*streamChunk
+	if size > streamChunk {
+		size = streamChunk
+	}
+
+	sealed := make([]byte, size+tagSize)
+	if _, err := e.file.ReadAt(sealed, e.start+i*(streamChunk+tagSize)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	chunk, err := openChunk(e.aead, e.prefix, uint32(i), i == chunks-1, e.ad, sealed[:0], sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	e.cached, e.last = i, chunk
+	return chunk, nil
+}
+
+// Close closes the file
+func (e *EncryptedFile) Close() error {
+	return e.file.Close()
+}
+
+// DecryptRange decrypts length bytes of src starting at offset, using the key in keyFile, and writes them to w.
+// Only the chunks covering the range are read.
+func DecryptRange(keyFile string, src string, offset int64, length int64, w io.Writer) error {
+	e, err := OpenEncrypted(keyFile, src)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+
+	if offset < 0 || length < 0 || offset+length > e.Size() {
+		return errRangeOutOfBounds(e.Size())
+	}
+
+	_, err = io.Copy(w, io.NewSectionReader(e, offset, length))
+	if err != nil {
+		return damaged(src, err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDecryptRange(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := make([]byte, 3*streamChunk+100)
+	rand.Read(original)
+	err = ioutil.WriteFile("data.txt", original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	e, err := OpenEncrypted("test.key", "data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if e.Size() != int64(len(original)) {
+		t.Fatalf("size is %d, expected %d", e.Size(), len(original))
+	}
+
+	// within a chunk, across chunks, and up to the end
+	for _, r := range [][2]int{{10, 20}, {streamChunk - 5, 2*streamChunk + 10}, {len(original) - 50, 50}, {0, 0}} {
+		var out bytes.Buffer
+		err = DecryptRange("test.key", "data.txt.shush", int64(r[0]), int64(r[1]), &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), original[r[0]:r[0]+r[1]]) {
+			t.Fatalf("range %v doesn't match", r)
+		}
+	}
+
+	err = DecryptRange("test.key", "data.txt.shush", int64(len(original)-10), 20, ioutil.Discard)
+	if err == nil {
+		t.Fatal("decrypted past the end of the file")
+	}
+
+	// reading past the end returns what's there
+	buf := make([]byte, 100)
+	n, err := e.ReadAt(buf, int64(len(original)-10))
+	if n != 10 || err != io.EOF || !bytes.Equal(buf[:n], original[len(original)-10:]) {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+}
@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+var errUnknownField = func(name string) error { return fmt.Errorf("unknown field \"%s\"", name) }
+
+// field is a finite field of characteristic 2, which secrets are shared over. Addition is xor in every such field.
+type field interface {
+	// name is recorded in shard headers, so that Merge picks the right arithmetic
+	name() string
+	// size is the number of bytes needed to store an element
+	size() int
+	// maxShards is the number of non-zero elements, which is the most x-coordinates a set can use
+	maxShards() int
+	mul(a, b uint32) uint32
+	inv(a uint32) uint32
+}
+
+// Fields lists the names of the fields that secrets can be split over
+var Fields = []string{"gf256", "gf65536"}
+
+var (
+	fieldGF256   field = gf256{}
+	fieldGF65536 field = newGF65536()
+)
+
+// fieldByName returns the field recorded in a shard header. Shards without one use GF(2^8).
+func fieldByName(name string) (field, error) {
+	switch name {
+	case "", "gf256":
+		return fieldGF256, nil
+	case "gf65536":
+		return fieldGF65536, nil
+	default:
+		return nil, errUnknownField(name)
+	}
+}
+
+// gf256 is GF(2^8), which is what older versions of shush used through hashicorp's shamir package
+type gf256 struct{}
+
+func (gf256) name() string           { return "gf256" }
+func (gf256) size() int              { return 1 }
+func (gf256) maxShards() int         { return 255 }
+func (gf256) mul(a, b uint32) uint32 { return uint32(gfMul(byte(a), byte(b))) }
+func (gf256) inv(a uint32) uint32    { return uint32(gfInv(byte(a))) }
+
+// gf65536 is GF(2^16), using the reducing polynomial x^16 + x^12 + x^3 + x + 1. Each element takes two bytes,
+// but a set can have up to 65535 shards.
+type gf65536 struct {
+	log []uint16
+	// exp is doubled in length, so that the sum of two logs never needs reducing
+	exp []uint16
+}
+
+func newGF65536() *gf65536 {
+	f := &gf65536{
+		log: make([]uint16, 1<<16),
+		exp: make([]uint16, 2*0xffff),
+	}
+
+	x := uint32(1)
+	for i := 0; i < 0xffff; i++ {
+		f.exp[i] = uint16(x)
+		f.exp[i+0xffff] = uint16(x)
+		f.log[x] = uint16(i)
+
+		x <<= 1
+		if x&0x10000 != 0 {
+			x ^= 0x1100b
+		}
+	}
+	return f
+}
+
+func (*gf65536) name() string   { return "gf65536" }
+func (*gf65536) size() int      { return 2 }
+func (*gf65536) maxShards() int { return 0xffff }
+
+func (f *gf65536) mul(a, b uint32) uint32 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return uint32(f.exp[int(f.log[a])+int(f.log[b])])
+}
+
+func (f *gf65536) inv(a uint32) uint32 {
+	if a == 0 {
+		panic("divide by zero")
+	}
+	return uint32(f.exp[0xffff-int(f.log[a])])
+}
+
+// getSymbol returns the i'th element stored in b
+func getSymbol(f field, b []byte, i int) uint32 {
+	if f.size() == 1 {
+		return uint32(b[i])
+	}
+	return uint32(b[2*i])<<8 | uint32(b[2*i+1])
+}
+
+// putSymbol stores v as the i'th element of b
+func putSymbol(f field, b []byte, i int, v uint32) {
+	if f.size() == 1 {
+		b[i] = byte(v)
+		return
+	}
+	b[2*i] = byte(v >> 8)
+	b[2*i+1] = byte(v)
+}
+
+// polynomial holds field elements, lowest degree first
+type polynomial []uint32
+
+// evaluate returns the value of the polynomial at x, using Horner's method
+func (p polynomial) evaluate(f field, x uint32) (out uint32) {
+	for i := len(p) - 1; i >= 0; i-- {
+		out = f.mul(out, x) ^ p[i]
+	}
+	return out
+}
+
+// lagrangeBasis returns the lagrange basis polynomials for xs. The polynomial that passes through the points
+// (xs[i], ys[i]) is the sum of ys[i] * basis[i], so the basis can be reused for every element of a shard.
+func lagrangeBasis(f field, xs []uint32) []polynomial {
+	basis := make([]polynomial, len(xs))
+	for i := range xs {
+		p := polynomial{1}
+		denom := uint32(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+
+			// multiply p by (x - xs[j])
+			next := make(polynomial, len(p)+1)
+			for k, c := range p {
+				next[k+1] ^= c
+				next[k] ^= f.mul(c, xs[j])
+			}
+			p = next
+			denom = f.mul(denom, xs[i]^xs[j])
+		}
+
+		inv := f.inv(denom)
+		for k := range p {
+			p[k] = f.mul(p[k], inv)
+		}
+		basis[i] = p
+	}
+	return basis
+}
+
+// interpolate returns the polynomial passing through the points (xs[i], ys[i])
+func interpolate(f field, basis []polynomial, ys []uint32) polynomial {
+	out := make(polynomial, len(basis))
+	for i, b := range basis {
+		for k, c := range b {
+			out[k] ^= f.mul(ys[i], c)
+		}
+	}
+	return out
+}
+
+// randomIndexes returns n distinct, random, non-zero x-coordinates that aren't in used
+func randomIndexes(f field, n int, used map[uint32]bool) ([]uint32, error) {
+	var free []uint32
+	for x := 1; x <= f.maxShards(); x++ {
+		if !used[uint32(x)] {
+			free = append(free, uint32(x))
+		}
+	}
+	if n > len(free) {
+		return nil, errTooManyShards(f)
+	}
+
+	// a partial Fisher-Yates shuffle
+	for i := 0; i < n; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(free)-i)))
+		if err != nil {
+			return nil, err
+		}
+		k := i + int(j.Int64())
+		free[i], free[k] = free[k], free[i]
+	}
+	return free[:n], nil
+}
+
+// splitField shares secret over f, which must be a whole number of elements long, returning the y-values of the
+// share at each x
+func splitField(f field, secret []byte, xs []uint32, threshold int) ([][]byte, error) {
+	symbols := len(secret) / f.size()
+	out := make([][]byte, len(xs))
+	for i := range xs {
+		out[i] = make([]byte, len(secret))
+	}
+
+	// a new random polynomial for every element of the secret
+	coefficients := make([]byte, symbols*(threshold-1)*f.size())
+	if _, err := rand.Read(coefficients); err != nil {
+		return nil, err
+	}
+
+	p := make(polynomial, threshold)
+	for idx := 0; idx < symbols; idx++ {
+		p[0] = getSymbol(f, secret, idx)
+		for k := 1; k < threshold; k++ {
+			p[k] = getSymbol(f, coefficients, idx*(threshold-1)+k-1)
+		}
+
+		for i, x := range xs {
+			putSymbol(f, out[i], idx, p.evaluate(f, x))
+		}
+	}
+
+	return out, nil
+}
+
+// lagrangeWeights returns the value at x of each of the lagrange basis polynomials for xs. The value at x of the
+// polynomial passing through (xs[i], ys[i]) is the sum of ys[i] * weights[i].
+func lagrangeWeights(f field, xs []uint32, x uint32) []uint32 {
+	weights := make([]uint32, len(xs))
+	for i, b := range lagrangeBasis(f, xs) {
+		weights[i] = b.evaluate(f, x)
+	}
+	return weights
+}
+
+// weightedSum returns the sum of ys[i] * weights[i], for every element of the shares
+func weightedSum(f field, weights []uint32, ys [][]byte) []byte {
+	out := make([]byte, len(ys[0]))
+	for idx := 0; idx < len(out)/f.size(); idx++ {
+		var v uint32
+		for i, y := range ys {
+			v ^= f.mul(getSymbol(f, y, idx), weights[i])
+		}
+		putSymbol(f, out, idx, v)
+	}
+	return out
+}
+
+// combineField reverses splitField, given at least a threshold of the shares
+func combineField(f field, xs []uint32, ys [][]byte) []byte {
+	return weightedSum(f, lagrangeWeights(f, xs, 0), ys)
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testFields = []field{fieldGF256, fieldGF65536}
+
+func TestFieldInverse(t *testing.T) {
+	for _, f := range testFields {
+		for a := 1; a <= f.maxShards(); a++ {
+			if f.mul(uint32(a), f.inv(uint32(a))) != 1 {
+				t.Fatalf("%s: %d * %d != 1", f.name(), a, f.inv(uint32(a)))
+			}
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	for _, f := range testFields {
+		p := polynomial{42, 7, 99}
+		xs := []uint32{3, 200, 17}
+		ys := make([]uint32, len(xs))
+		for i, x := range xs {
+			ys[i] = p.evaluate(f, x)
+		}
+
+		recovered := interpolate(f, lagrangeBasis(f, xs), ys)
+		for i := range p {
+			if recovered[i] != p[i] {
+				t.Fatalf("%s: recovered %v, expected %v", f.name(), recovered, p)
+			}
+		}
+	}
+}
+
+func TestSplitCombineField(t *testing.T) {
+	secret := []byte("an even length secret!")
+
+	for _, f := range testFields {
+		xs, err := randomIndexes(f, 300%f.maxShards(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shares, err := splitField(f, secret, xs, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recovered := combineField(f, []uint32{xs[40], xs[2], xs[11]}, [][]byte{shares[40], shares[2], shares[11]})
+		if !bytes.Equal(recovered, secret) {
+			t.Fatalf("%s: recovered %q", f.name(), recovered)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package lib
+
+// Arithmetic in GF(2^8), using the same reducing polynomial (x^8 + x^4 + x^3 + x + 1) as hashicorp's shamir
+// package, so that we can still read the shards that older versions of shush wrote with it.
+
+// gfMul multiplies two numbers in GF(2^8), without branching on either value
+func gfMul(a, b byte) (out byte) {
+	for i := 0; i < 8; i++ {
+		out ^= -(b & 1) & a
+		b >>= 1
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+	}
+	return out
+}
+
+// gfInv returns the multiplicative inverse of a, which is a^254 since the group has order 255
+func gfInv(a byte) byte {
+	out := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		out = gfMul(out, a)
+	}
+	return out
+}
+
+// gfMulTable caches every product, for working through whole blocks of data
+var gfMulTable [256][256]byte
+
+func init() {
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			gfMulTable[a][b] = gfMul(byte(a), byte(b))
+		}
+	}
+}
+
+// gfMulAdd adds c * src to dst, byte by byte
+func gfMulAdd(dst []byte, src []byte, c byte) {
+	row := &gfMulTable[c]
+	for i, b := range src {
+		dst[i] ^= row[b]
+	}
+}
+
+// gfMatrix is a square matrix over GF(2^8)
+type gfMatrix [][]byte
+
+// invert returns the inverse of m, using gauss-jordan elimination
+func (m gfMatrix) invert() (gfMatrix, bool) {
+	n := len(m)
+	work := make(gfMatrix, n)
+	inv := make(gfMatrix, n)
+	for i := range m {
+		work[i] = append([]byte{}, m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, false
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(work[col][col])
+		for k := 0; k < n; k++ {
+			work[col][k] = gfMul(work[col][k], scale)
+			inv[col][k] = gfMul(inv[col][k], scale)
+		}
+
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			c := work[row][col]
+			gfMulAdd(work[row], work[col], c)
+			gfMulAdd(inv[row], inv[col], c)
+		}
+	}
+	return inv, true
+}
@@ -0,0 +1,35 @@
+package lib
+
+import "testing"
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("%d * %d != 1", a, gfInv(byte(a)))
+		}
+	}
+}
+
+func TestGFMatrixInvert(t *testing.T) {
+	m := gfMatrix{{1, 0, 0}, {0, 1, 0}, {gfInv(3), gfInv(4), gfInv(5)}}
+	inv, ok := m.invert()
+	if !ok {
+		t.Fatal("matrix should be invertible")
+	}
+
+	for i := range m {
+		for j := range m {
+			var v byte
+			for k := range m {
+				v ^= gfMul(m[i][k], inv[k][j])
+			}
+			if (i == j && v != 1) || (i != j && v != 0) {
+				t.Fatalf("m * inverse isn't the identity at %d,%d", i, j)
+			}
+		}
+	}
+
+	if _, ok := (gfMatrix{{1, 2}, {1, 2}}).invert(); ok {
+		t.Fatal("singular matrix shouldn't be invertible")
+	}
+}
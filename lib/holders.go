@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	validHolderName    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	errInvalidHolder   = func(h string) error { return fmt.Errorf("invalid holder \"%s\"; expected name:weight", h) }
+	errDuplicateHolder = func(name string) error { return fmt.Errorf("holder \"%s\" is listed more than once", name) }
+)
+
+// Holder is a named shard holder, whose shard counts as Weight shares towards the threshold
+type Holder struct {
+	Name   string
+	Weight int
+}
+
+// ParseHolders parses a list of holders like "cto:3,cfo:2,eng1,eng2". Holders without a weight get a weight of 1.
+// Names end up in file names, so they are limited to letters, numbers, dashes and underscores.
+func ParseHolders(list string) ([]Holder, error) {
+	var holders []Holder
+	seen := map[string]bool{}
+	for _, h := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(h), ":", 2)
+
+		holder := Holder{Name: parts[0], Weight: 1}
+		if len(parts) == 2 {
+			weight, err := strconv.Atoi(parts[1])
+			if err != nil || weight < 1 {
+				return nil, errInvalidHolder(h)
+			}
+			holder.Weight = weight
+		}
+
+		if !validHolderName.MatchString(holder.Name) {
+			return nil, errInvalidHolder(h)
+		}
+		if seen[holder.Name] {
+			return nil, errDuplicateHolder(holder.Name)
+		}
+		seen[holder.Name] = true
+
+		holders = append(holders, holder)
+	}
+	return holders, nil
+}
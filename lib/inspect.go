@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var errUnknownFile = func(path string) error {
+	return fmt.Errorf("\"%s\" doesn't look like a key, a shard or a file encrypted by shush", path)
+}
+
+// inspectLimit is the most of a file without a header that's read, to tell keys and old shards apart
+const inspectLimit = 1 << 20
+
+// detail is one line of what Inspect found
+type detail struct {
+	name  string
+	value string
+}
+
+// Inspect prints what kind of shush file path is, and what its header says about it. No key is needed, and nothing
+// secret is printed.
+func Inspect(path string) error {
+	details, err := inspect(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n", path)
+	for _, d := range details {
+		fmt.Printf("  %-13s %s\n", d.name+":", d.value)
+	}
+	return nil
+}
+
+// inspect identifies the file at path, and describes it
+func inspect(path string) ([]detail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errUnknownFile(path)
+	}
+
+	// shards and encrypted files both start with a json header, but only shards belong to a set
+	r := bufio.NewReader(file)
+	if shardLike(r) {
+		s, err := openShard(path)
+		if err != nil {
+			return nil, err
+		}
+		defer s.close()
+		return inspectShard(s), nil
+	}
+
+	header, ad, err := readEncryptHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		return inspectEncrypted(path, header, info.Size()-int64(len(ad)))
+	}
+
+	// keys and old shards are base64, without a header
+	if info.Size() <= inspectLimit {
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		defer wipe(contents)
+
+		trimmed := bytes.TrimSpace(contents)
+		if bytes.HasPrefix(trimmed, []byte("-----BEGIN")) {
+			k, err := decodeKey(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			defer k.wipe()
+			return inspectKey(k, "PEM"), nil
+		}
+		if key := base64decode(trimmed); len(key) == keySize && len(base64encode(key)) == len(trimmed) {
+			k, err := decodeKey(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			defer k.wipe()
+			return inspectKey(k, "base64, written before key files had headers"), nil
+		}
+
+		// anything can be decoded leniently, so only valid base64 could be a shard
+		_, err = base64.StdEncoding.DecodeString(string(trimmed))
+		if err == nil && !strings.HasSuffix(path, encryptExt) {
+			if s, err := openShard(path); err == nil {
+				defer s.close()
+				return inspectShard(s), nil
+			}
+		}
+	}
+
+	if strings.HasSuffix(path, encryptExt) {
+		return []detail{
+			{"Type", "encrypted file"},
+			{"Version", "1, written before shush sealed files in chunks"},
+			{"Cipher", Ciphers[0]},
+		}, nil
+	}
+	return nil, errUnknownFile(path)
+}
+
+// shardLike reports whether r starts with a shard header
+func shardLike(r *bufio.Reader) bool {
+	line, _ := r.Peek(4096)
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	var header struct {
+		Set *string `json:"set"`
+	}
+	return len(line) > 0 && line[0] == '{' && json.Unmarshal(line, &header) == nil && header.Set != nil
+}
+
+// inspectKey describes a key file in format, without its key
+func inspectKey(k *keyFile, format string) []detail {
+	details := []detail{{"Type", "key"}, {"Format", format}, {"Key type", k.Type}}
+	if k.Type == keyProtected {
+		details = append(details, detail{"Protection", fmt.Sprintf("a passphrase, stretched with %s (%s)", k.KDF, k.params)})
+	}
+	if k.Algorithm != "" {
+		details = append(details, detail{"Algorithm", k.Algorithm})
+	}
+	details = append(details, detail{"Key ID", k.ID})
+	if k.Label != "" {
+		details = append(details, detail{"Label", k.Label})
+	}
+	if k.Created != nil {
+		details = append(details, detail{"Created", k.Created.Format(time.RFC3339)})
+	}
+	return details
+}
+
+// inspectEncrypted describes an encrypted file, whose stream is sealed bytes long
+func inspectEncrypted(path string, header *encryptHeader, sealed int64) ([]detail, error) {
+	cipherName := header.Cipher
+	if cipherName == "" {
+		cipherName = Ciphers[0]
+	}
+
+	details := []detail{
+		{"Type", "encrypted file"},
+		{"Version", fmt.Sprint(header.Version)},
+		{"Cipher", cipherName},
+	}
+	if header.KeyID != "" {
+		details = append(details, detail{"Key ID", header.KeyID})
+	}
+
+	// the length of a stream follows from the length of the file, which only needs the size of the cipher's nonce
+	length := fmt.Sprintf("%d bytes", header.Length)
+	if header.Length < 0 {
+		length = "unknown until decrypted"
+		aead, err := newCipher(header.Cipher, make([]byte, keySize))
+		if err != nil {
+			return nil, err
+		}
+		if n := openedLength(aead, sealed); n >= 0 && header.Compression == "" {
+			length = fmt.Sprintf("%d bytes", n)
+		}
+	}
+	details = append(details, detail{"Length", length})
+
+	if header.Archive != "" {
+		details = append(details, detail{"Contents", fmt.Sprintf("a directory, archived with %s", header.Archive)})
+	}
+	if header.Compression != "" {
+		details = append(details, detail{"Compression", header.Compression})
+	}
+	if len(header.Salt) > 0 {
+		details = append(details, detail{"File key", "derived from the key and a salt"})
+	} else {
+		details = append(details, detail{"File key", "the key itself"})
+	}
+	if len(header.Metadata) > 0 {
+		details = append(details, detail{"Metadata", "name, permissions and modification time, sealed"})
+	}
+	if header.Created != nil {
+		details = append(details, detail{"Created", header.Created.Format(time.RFC3339)})
+	}
+	if _, err := os.Stat(path + parityExt); err == nil {
+		details = append(details, detail{"Parity", path + parityExt})
+	}
+	return details, nil
+}
+
+// inspectShard describes an open shard
+func inspectShard(s *shard) []detail {
+	h := s.header
+	if h == nil {
+		return []detail{
+			{"Type", "shard"},
+			{"Version", "0, written before shush tracked sets"},
+			{"Field", s.field.name()},
+			{"Length", fmt.Sprintf("%d bytes", s.length)},
+		}
+	}
+
+	details := []detail{
+		{"Type", "shard"},
+		{"Version", fmt.Sprint(h.Version)},
+		{"Set", h.Set},
+		{"Index", fmt.Sprint(h.Index)},
+	}
+	if h.Holder != "" {
+		details = append(details, detail{"Holder", h.Holder})
+	}
+	if h.Policy != nil {
+		details = append(details,
+			detail{"Policy", fmt.Sprintf("%d of %d at the top level", h.Policy.Threshold,
+				len(h.Policy.Groups)+len(h.Policy.Members))},
+			detail{"Holders", strings.Join(h.Policy.holders(), ", ")})
+	} else {
+		details = append(details, detail{"Threshold", fmt.Sprint(h.Threshold)})
+		if len(h.Issued) > 0 {
+			details = append(details, detail{"Issued", fmt.Sprintf("%d shards", len(h.Issued))})
+		}
+	}
+	details = append(details, detail{"Shares", fmt.Sprint(s.weight)}, detail{"Field", h.Field})
+	if h.Dispersed > 0 {
+		details = append(details, detail{"Compact", "yes"})
+	}
+	details = append(details, detail{"Length", fmt.Sprintf("%d bytes", h.Length)})
+	if h.KeyID != "" {
+		details = append(details, detail{"Key ID", h.KeyID})
+	}
+	if h.Protection != nil {
+		details = append(details, detail{"Protection", fmt.Sprintf("a passphrase, stretched with %s (%s)",
+			h.Protection.KDF, h.Protection.Params)})
+	}
+	if len(h.Digest) > 0 {
+		details = append(details, detail{"Digest", "recorded, so verify-set can check the set"})
+	}
+	if h.Created != nil {
+		details = append(details, detail{"Created", h.Created.Format(time.RFC3339)})
+	}
+	return details
+}
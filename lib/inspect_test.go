@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// describes returns the value of each detail
+func describes(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	details, err := inspect(path)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	values := map[string]string{}
+	for _, d := range details {
+		values[d.name] = d.value
+	}
+	return values
+}
+
+func TestInspect(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testKey(t, "test.key")
+	id, err := keyID(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	details := describes(t, "test.key")
+	if details["Type"] != "key" || details["Key ID"] != id {
+		t.Fatalf("the key was described as %v", details)
+	}
+
+	info, err := os.Stat("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Split("test.key", 5, 3, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	details = describes(t, "test.key.shard2")
+	if details["Type"] != "shard" || details["Index"] != "2" || details["Threshold"] != "3" ||
+		details["Length"] != fmt.Sprintf("%d bytes", info.Size()) || details["Key ID"] != id ||
+		details["Created"] == "" {
+		t.Fatalf("the shard was described as %v", details)
+	}
+	for _, d := range details {
+		if d == string(base64encode(key)) {
+			t.Fatal("the key was printed")
+		}
+	}
+
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Encrypt("test.key", "data.txt", EncryptOptions{Cipher: "xchacha20poly1305"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	details = describes(t, "data.txt.shush")
+	if details["Type"] != "encrypted file" || details["Cipher"] != "xchacha20poly1305" ||
+		details["Version"] != "2" {
+		t.Fatalf("the encrypted file was described as %v", details)
+	}
+
+	// the length of a directory follows from the length of the file
+	writeTestDir(t, []byte("big"))
+	err = EncryptDir("test.key", "secrets", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	details = describes(t, "secrets.shush")
+	if details["Contents"] == "" || details["Length"] == "unknown until decrypted" {
+		t.Fatalf("the directory was described as %v", details)
+	}
+
+	deleteTestFiles()
+	for name, contents := range legacyShards {
+		err := ioutil.WriteFile(name, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if details := describes(t, "test.key.shard0"); details["Type"] != "shard" || details["Length"] != "15 bytes" {
+		t.Fatalf("the legacy shard was described as %v", details)
+	}
+
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inspect("data.txt"); err == nil {
+		t.Fatal("an ordinary file was identified")
+	}
+}
@@ -0,0 +1,308 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	keyBlockType = "SHUSH KEY"
+	// keySymmetric is the type of a plain 256-bit key
+	keySymmetric = "symmetric"
+	// keyProtected is the type of a 256-bit key that's sealed with a key derived from a passphrase
+	keyProtected = "protected"
+	// kdfSaltSize is the length of the random salt a passphrase is stretched with
+	kdfSaltSize = 16
+	// maxKDFTime and maxKDFMemory, in KiB, bound the params we'll read from a file, which could otherwise have us
+	// allocate terabytes before a passphrase is even checked
+	maxKDFTime   = 100
+	maxKDFMemory = 4 * 1024 * 1024
+)
+
+// kdfParams are how hard Argon2id works to turn a passphrase into a key. They're recorded in each protected key file,
+// so they can be raised later without breaking older keys.
+type kdfParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+var defaultKDF = kdfParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+var (
+	errKeyChecksum    = errors.New("the key file is damaged; its checksum doesn't match")
+	errInvalidLabel   = errors.New("labels must be a single line of at most 64 characters")
+	errUnknownKeyType = func(t string) error {
+		return fmt.Errorf("key type \"%s\" is not supported by this version of shush", t)
+	}
+	errWrongPassphrase = func(id string) error { return fmt.Errorf("wrong passphrase for key %s", id) }
+	errInvalidKDF      = errors.New("the passphrase settings are invalid, or too costly to be real")
+)
+
+// GenOptions changes how a key is generated
+type GenOptions struct {
+	// Label is a note recorded in the key file, like what the key protects
+	Label string
+	// Protect seals the key with a passphrase, which is asked for whenever the key is used
+	Protect bool
+}
+
+// Key files are PEM blocks of type SHUSH KEY, whose headers describe the key, and whose body is the key itself:
+//
+//	-----BEGIN SHUSH KEY-----
+//	Algorithm: aes256gcm, xchacha20poly1305
+//	Checksum: 5c1e03a7
+//	Created: 2024-03-31T12:00:00Z
+//	Key-Id: 7F3A-91C2
+//	Label: family photos
+//	Type: symmetric
+//
+//	...
+//	-----END SHUSH KEY-----
+//
+// The checksum catches damage to the key, and the key ID is checked against the key too. Key files written before
+// this format are the key in base64, and are still read.
+//
+// Protected keys have the type "protected", and their body is a nonce followed by the key, sealed with AES-256-GCM
+// under a key stretched from a passphrase with Argon2id. The headers say how it was stretched:
+//
+//	Kdf: argon2id
+//	Kdf-Params: time=3, memory=65536, threads=4
+//	Kdf-Salt: ...
+//
+// Their checksum covers the sealed body, so that damage can be told apart from a wrong passphrase.
+
+// keyFile is a decoded key file
+type keyFile struct {
+	Type      string
+	Algorithm string
+	ID        string
+	Created   *time.Time
+	Label     string
+	KDF       string
+	// key is nil until a protected key has been unsealed
+	key    []byte
+	sealed []byte
+	params kdfParams
+	salt   []byte
+}
+
+// encodeKey returns the contents of a new key file for key. If passphrase isn't nil, the key is sealed with it.
+func encodeKey(key []byte, label string, passphrase []byte) ([]byte, error) {
+	if len(label) > 64 || strings.ContainsAny(label, "\r\n") {
+		return nil, errInvalidLabel
+	}
+
+	id, err := keyID(key)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"Type":      keySymmetric,
+		"Algorithm": strings.Join(Ciphers, ", "),
+		"Key-Id":    id,
+		"Created":   created().Format(time.RFC3339),
+		"Checksum":  keyChecksum(key),
+	}
+	if label != "" {
+		headers["Label"] = label
+	}
+	if passphrase == nil {
+		return pem.EncodeToMemory(&pem.Block{Type: keyBlockType, Headers: headers, Bytes: key}), nil
+	}
+
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	params := defaultKDF
+	wrapping := params.key(passphrase, salt)
+	aead, err := newGCM(wrapping)
+	wipe(wrapping)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, key, []byte(id))
+
+	headers["Type"] = keyProtected
+	headers["Kdf"] = "argon2id"
+	headers["Kdf-Params"] = params.String()
+	headers["Kdf-Salt"] = base64.StdEncoding.EncodeToString(salt)
+	headers["Checksum"] = keyChecksum(sealed)
+	return pem.EncodeToMemory(&pem.Block{Type: keyBlockType, Headers: headers, Bytes: sealed}), nil
+}
+
+// decodeKey decodes the contents of a key file, in either format
+func decodeKey(contents []byte) (*keyFile, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		// older key files are just the key in base64
+		key := base64decode(contents)
+		if len(key) != keySize {
+			wipe(key)
+			return nil, errInvalidKey
+		}
+		id, err := keyID(key)
+		if err != nil {
+			return nil, err
+		}
+		return &keyFile{Type: keySymmetric, ID: id, key: key}, nil
+	}
+
+	if block.Type != keyBlockType {
+		return nil, errInvalidKey
+	}
+	k := &keyFile{
+		Type:      block.Headers["Type"],
+		Algorithm: block.Headers["Algorithm"],
+		ID:        block.Headers["Key-Id"],
+		Label:     block.Headers["Label"],
+	}
+	if created, err := time.Parse(time.RFC3339, block.Headers["Created"]); err == nil {
+		k.Created = &created
+	}
+	if block.Headers["Checksum"] != keyChecksum(block.Bytes) {
+		wipe(block.Bytes)
+		return nil, errKeyChecksum
+	}
+
+	switch k.Type {
+	case keySymmetric:
+		k.key = block.Bytes
+		if err := k.check(); err != nil {
+			k.wipe()
+			return nil, err
+		}
+	case keyProtected:
+		k.KDF = block.Headers["Kdf"]
+		k.sealed = block.Bytes
+		k.salt, _ = base64.StdEncoding.DecodeString(block.Headers["Kdf-Salt"])
+		_, err := fmt.Sscanf(block.Headers["Kdf-Params"], "time=%d, memory=%d, threads=%d",
+			&k.params.Time, &k.params.Memory, &k.params.Threads)
+		if err != nil || k.KDF != "argon2id" || len(k.salt) == 0 || !k.params.valid() {
+			return nil, errInvalidKDF
+		}
+	default:
+		return nil, errUnknownKeyType(k.Type)
+	}
+	return k, nil
+}
+
+// check makes sure the key is the one the key file says it is
+func (k *keyFile) check() error {
+	if len(k.key) != keySize {
+		return errInvalidKey
+	}
+	if id, err := keyID(k.key); err != nil || id != k.ID {
+		return errKeyChecksum
+	}
+	return nil
+}
+
+// wipe zeroes the key, once it's been used or copied somewhere safer
+func (k *keyFile) wipe() {
+	wipe(k.key)
+}
+
+// unseal opens a protected key with its passphrase
+func (k *keyFile) unseal(passphrase []byte) error {
+	wrapping := k.params.key(passphrase, k.salt)
+	aead, err := newGCM(wrapping)
+	wipe(wrapping)
+	if err != nil {
+		return err
+	}
+	if len(k.sealed) < aead.NonceSize() {
+		return errInvalidKey
+	}
+
+	nonce, sealed := k.sealed[:aead.NonceSize()], k.sealed[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, []byte(k.ID))
+	if err != nil {
+		return errWrongPassphrase(k.ID)
+	}
+	k.key = key
+	if err := k.check(); err != nil {
+		k.wipe()
+		return err
+	}
+	return nil
+}
+
+// key stretches a passphrase into a key
+func (p kdfParams) key(passphrase []byte, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, keySize)
+}
+
+// valid reports whether Argon2id can run with the params, within reason
+func (p kdfParams) valid() bool {
+	return p.Time >= 1 && p.Time <= maxKDFTime && p.Memory <= maxKDFMemory && p.Threads >= 1
+}
+
+func (p kdfParams) String() string {
+	return fmt.Sprintf("time=%d, memory=%d, threads=%d", p.Time, p.Memory, p.Threads)
+}
+
+// keyChecksum returns the checksum of a key, which is the start of its SHA-256 hash
+func keyChecksum(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// parseKey returns the key in the contents of a key file, asking for its passphrase if it's protected
+func parseKey(contents []byte) (*secureBuffer, error) {
+	k, err := decodeKey(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Type == keyProtected {
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for key %s: ", k.ID))
+		if err != nil {
+			return nil, err
+		}
+		err = k.unseal(passphrase)
+		wipe(passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return secureCopy(k.key), nil
+}
+
+// secretKeyID returns the ID of the key in a secret, or nothing if the secret isn't exactly a key file. Protected keys
+// aren't unsealed, so their ID is taken from the header.
+func secretKeyID(secret []byte) (string, error) {
+	trimmed := bytes.TrimSpace(secret)
+	if !bytes.HasPrefix(trimmed, []byte("-----BEGIN")) {
+		// anything decodes as base64 leniently, so older key files have to match exactly
+		key := base64decode(trimmed)
+		legacy := len(key) == keySize && bytes.Equal(base64encode(key), trimmed)
+		wipe(key)
+		if !legacy {
+			return "", nil
+		}
+	}
+
+	k, err := decodeKey(secret)
+	if err != nil {
+		return "", nil
+	}
+	k.wipe()
+	return k.ID, nil
+}
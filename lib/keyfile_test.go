@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{Label: "family photos"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(contents, []byte("-----BEGIN SHUSH KEY-----\n")) {
+		t.Fatalf("expected a PEM key file, got\n%s", contents)
+	}
+
+	k, err := decodeKey(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := keyID(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Type != keySymmetric || k.ID != id || k.Label != "family photos" || k.Created == nil {
+		t.Fatalf("unexpected key file %+v", k)
+	}
+
+	// keys written before the format had headers still work
+	err = ioutil.WriteFile("new.key", base64encode(k.key), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := testKey(t, "new.key")
+	if !bytes.Equal(legacy, k.key) {
+		t.Fatal("the legacy key was read differently")
+	}
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Encrypt("new.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Verify("test.key", "data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// damage to the key is caught by its checksum
+	lines := strings.Split(string(contents), "\n")
+	for i, line := range lines {
+		if line == "" {
+			body := []byte(lines[i+1])
+			if body[0] == 'A' {
+				body[0] = 'B'
+			} else {
+				body[0] = 'A'
+			}
+			lines[i+1] = string(body)
+			break
+		}
+	}
+	_, err = decodeKey([]byte(strings.Join(lines, "\n")))
+	if err != errKeyChecksum {
+		t.Fatal("expected a checksum error, got", err)
+	}
+
+	// keys of types this version doesn't know are refused
+	unknown := strings.Replace(string(contents), "Type: symmetric", "Type: x25519", 1)
+	_, err = decodeKey([]byte(unknown))
+	if err == nil || err.Error() != errUnknownKeyType("x25519").Error() {
+		t.Fatal("expected an unknown key type error, got", err)
+	}
+
+	err = Gen("new.key.2", GenOptions{Label: "two\nlines"})
+	if err != errInvalidLabel {
+		t.Fatal("expected an invalid label error, got", err)
+	}
+}
+
+// passphrases answers the next prompts for a passphrase with answers, in order
+func passphrases(t *testing.T, answers ...string) {
+	original := readPassphrase
+	t.Cleanup(func() { readPassphrase = original })
+
+	readPassphrase = func(prompt string) ([]byte, error) {
+		if len(answers) == 0 {
+			t.Fatalf("unexpected prompt %q", prompt)
+		}
+		answer := answers[0]
+		answers = answers[1:]
+		return []byte(answer), nil
+	}
+}
+
+func TestProtectedKey(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	// typos in the passphrase are caught before the key is written
+	passphrases(t, "correct horse", "correct hrose")
+	err := Gen("test.key", GenOptions{Protect: true})
+	if err != errPassphraseMismatch {
+		t.Fatal("expected mismatched passphrases to fail, got", err)
+	}
+
+	passphrases(t, "correct horse", "correct horse")
+	err = Gen("test.key", GenOptions{Protect: true, Label: "backups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "Type: protected\n") || !strings.Contains(string(contents), "Kdf: argon2id\n") {
+		t.Fatalf("expected a protected key file, got\n%s", contents)
+	}
+
+	// the key can be described and split without its passphrase
+	k, err := decodeKey(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := describes(t, "test.key")
+	if details["Key type"] != keyProtected || details["Key ID"] != k.ID || details["Protection"] == "" {
+		t.Fatalf("the protected key was described as %v", details)
+	}
+	err = Split("test.key", 3, 2, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openShard("test.key.shard0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if s.header.KeyID != k.ID {
+		t.Fatalf("the shards record key %q, expected %q", s.header.KeyID, k.ID)
+	}
+
+	// using it asks for the passphrase
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrases(t, "correct horse")
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	passphrases(t, "battery staple")
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err == nil || err.Error() != errWrongPassphrase(k.ID).Error() {
+		t.Fatal("expected the wrong passphrase to fail, got", err)
+	}
+
+	passphrases(t, "correct horse")
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadFile("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != testData {
+		t.Fatal("the decrypted file doesn't match")
+	}
+
+	// settings that would take forever, or all of our memory, are refused before asking for the passphrase
+	for _, params := range []string{"time=3, memory=4294967295, threads=4", "time=4294967295, memory=65536, threads=4"} {
+		costly := strings.Replace(string(contents), "time=3, memory=65536, threads=4", params, 1)
+		if _, err := decodeKey([]byte(costly)); err != errInvalidKDF {
+			t.Fatalf("%s: expected invalid settings, got %v", params, err)
+		}
+	}
+}
@@ -1,166 +1,956 @@
 package lib
 
 import (
-	"crypto/aes"
+	"bufio"
+	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/hashicorp/vault/shamir"
+	"time"
 )
 
 const (
-	keySize    = 32
-	nonceSize  = 12
-	encryptExt = ".shush"
-	shardExt   = ".shard"
+	keySize = 32
+	// keyFileLimit is the most that a key file could hold
+	keyFileLimit = 4096
+	nonceSize    = 12
+	encryptExt   = ".shush"
+	shardExt     = ".shard"
+	// encryptVersion is the version of the encrypted file format
+	encryptVersion = 2
+	// maxHeaderLine is the longest header line we'll read from an encrypted file
+	maxHeaderLine = 64 * 1024
 )
 
 var (
 	errInvalidKey        = errors.New("invalid key file provided")
 	errNotShushEncrypted = errors.New("provided file isn't shush encrypted")
 	errNotEnoughShards   = errors.New("You must supply at least 2 shards to attempt to combine them into a secret")
-	errFileExists        = func(path string) error { return fmt.Errorf("cannot write \"%s\"; file already exists", path) }
+	errEmptySecret       = errors.New("cannot split an empty secret")
+	errInvalidThreshold  = errors.New("the threshold must be at least 2, and no more than the number of shares")
+	errDamaged           = func(path string) error {
+		return fmt.Errorf("could not decrypt \"%s\"; check the key, or run \"shush repair %s\"", path, path)
+	}
+	errUnsupportedFile = func(version int) error {
+		return fmt.Errorf("encrypted file version %d is not supported by this version of shush", version)
+	}
+	errFileExists = func(path string) error { return fmt.Errorf("cannot write \"%s\"; file already exists", path) }
 )
 
-// Gen creates a new aes key and writes it to disk
-func Gen(keyName string) error {
-	key := make([]byte, keySize)
+// Gen creates a new key and writes it to disk
+func Gen(keyName string, opts GenOptions) error {
+	buf := newSecureBuffer(keySize)
+	defer buf.release()
+	key := buf.bytes()
 	_, err := rand.Read(key)
 	if err != nil {
 		return err
 	}
 
-	err = safeWrite(keyName, base64encode(key), 0600)
+	id, err := keyID(key)
+	if err != nil {
+		return err
+	}
+
+	var passphrase []byte
+	if opts.Protect {
+		passphrase, err = newPassphrase(fmt.Sprintf("Passphrase to protect key %s: ", id))
+		if err != nil {
+			return err
+		}
+	}
+
+	contents, err := encodeKey(key, opts.Label, passphrase)
+	wipe(passphrase)
+	if err != nil {
+		return err
+	}
+	defer wipe(contents)
+
+	err = safeWrite(keyName, contents, 0600)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote key %s to %s\n\n", id, keyName)
+
+	return nil
+}
+
+// SplitOptions changes how a secret is split
+type SplitOptions struct {
+	// Field is the name of the field to share the secret over, from Fields. GF(2^8) is used by default, which
+	// allows up to 255 shards.
+	Field string
+	// Holders writes a named shard for each holder, holding as many shares as their weight. When set, the number
+	// of shares is the sum of the weights, and the number of parts is ignored.
+	Holders []Holder
+	// Policy writes a shard for each of its members instead, and the number of parts and threshold are ignored
+	Policy *Policy
+	// Compact encrypts the secret with a random key, and spreads the ciphertext over the shards so that each one is
+	// about 1/threshold the size of the secret. Only the key is shared with shamir.
+	Compact bool
+	// Protect asks each holder in turn for a passphrase, which their shard is sealed with
+	Protect bool
+}
+
+// Split reads the fileName a block at a time, and writes the shards to disk
+func Split(file string, parts int, threshold int, opts SplitOptions) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	return splitStream(in, info.Size(), file, parts, threshold, opts)
+}
+
+// Merge reads the files, and writes the recovered secret as it goes
+func Merge(files []string) error {
+	shards, err := openShards(files)
+	if err != nil {
+		return err
+	}
+	defer closeShards(shards)
+
+	secret, _, err := combineShards(files, shards)
+	if err != nil {
+		return err
+	}
+
+	dst := mergedName(files)
+	out, err := safeCreate(dst, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, secret)
+	if err != nil {
+		// don't leave part of the secret behind
+		out.abort()
+		return err
+	}
+	if err := out.commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote result to %s\n\n", dst)
+
+	return nil
+}
+
+// Reshare recovers the secret from the files a block at a time, and writes a new set of shards to dst.
+// An empty dst writes the new set next to the first shard, like Merge would.
+func Reshare(files []string, dst string, parts int, threshold int, opts SplitOptions) error {
+	shards, err := openShards(files)
+	if err != nil {
+		return err
+	}
+	defer closeShards(shards)
+
+	secret, length, err := combineShards(files, shards)
+	if err != nil {
+		return err
+	}
+
+	if dst == "" {
+		dst = mergedName(files)
+	}
+
+	return splitStream(secret, length, dst, parts, threshold, opts)
+}
+
+// Extend reads a threshold of shards from a set, and writes one more shard for the same secret.
+// The existing shards stay valid, and the secret is never reconstructed. The new shard steers clear of the indexes
+// that the shards know were issued, and of any other shards from the set next to them, but a shard issued somewhere
+// else can only be known about by extending from it, so extends should chain from the newest shard.
+func Extend(files []string) error {
+	shards, err := openShards(files)
+	if err != nil {
+		return err
+	}
+	defer closeShards(shards)
+
+	for _, s := range shards {
+		if s.header == nil {
+			return errMissingSetInfo
+		}
+		if s.header.Policy != nil {
+			return errPolicyExtend
+		}
+	}
+
+	err = checkSet(shards)
+	if err != nil {
+		return err
+	}
+
+	// pick a random index that none of these shards, or the shards next to them, know about
+	f := shards[0].field
+	known := append(siblingShards(mergedName(files), shards[0].header.Set), shards...)
+	issued := issuedIndexes(known)
+	xs, err := randomIndexes(f, 1, issued)
+	if err != nil {
+		return err
+	}
+	taken := map[int]bool{}
+	for _, s := range known {
+		taken[s.header.Index] = true
+	}
+
+	header := *shards[0].header
+	header.Version = shardVersion
+	header.Index = len(issued)
+	for taken[header.Index] {
+		header.Index++
+	}
+	header.Holder = ""
+	header.Weight = 1
+	header.Xs = []int{int(xs[0])}
+	header.Block = blockSymbols(f, 1)
+	header.Created = created()
+	header.Issued = header.Issued[:0:0]
+	header.Protection = nil
+	issued[xs[0]] = true
+	for x := 1; x <= f.maxShards(); x++ {
+		if issued[uint32(x)] {
+			header.Issued = append(header.Issued, x)
+		}
+	}
+
+	// every element of the new share is the same combination of the old ones
+	threshold := header.Threshold
+	weights := lagrangeWeights(f, shareXs(shards)[:threshold], xs[0])
+	block := blockSymbols(f, countShares(shards))
+
+	// the new shard is protected too, if the set is
+	dst := shardName(mergedName(files), &header)
+	var key []byte
+	for _, s := range shards {
+		if s.header.Protection != nil && key == nil {
+			key, err = protectShard(dst, &header)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	w, err := createShard(dst, &header, key)
+	wipe(key)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Wrote key to %s\n\n", keyName)
+	for {
+		ys, err := readShares(shards, block*f.size())
+		if err == io.EOF {
+			break
+		} else if err == nil {
+			err = w.write([][]byte{weightedSum(f, weights, ys[:threshold])})
+			wipeAll(ys)
+		}
+		if err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully wrote shard %s\n\n", dst)
 
 	return nil
 }
 
-// Split reads the fileName, and writes the shards to disk
-func Split(file string, parts int, threshold int) error {
-	secret, err := ioutil.ReadFile(file)
+// splitStream splits the length bytes of secret in r a block at a time, and writes the shards to disk using name as
+// the base file name
+func splitStream(r io.Reader, length int64, name string, parts int, threshold int, opts SplitOptions) error {
+	f, err := fieldByName(opts.Field)
 	if err != nil {
 		return err
 	}
 
-	shards, err := shamir.Split(secret, parts, threshold)
+	if length == 0 {
+		return errEmptySecret
+	}
+	r = &lengthReader{r: r, left: length}
+
+	// shards of a key record its ID, which is small enough to look at before splitting
+	var id string
+	if length <= keyFileLimit {
+		b := bufio.NewReader(r)
+		secret, err := b.Peek(int(length))
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		id, err = secretKeyID(secret)
+		if err != nil {
+			return err
+		}
+		r = b
+	}
+
+	if opts.Policy != nil {
+		if opts.Compact {
+			return errCompactPolicy
+		}
+
+		headers, err := newPolicySet(opts.Policy, int(length))
+		if err != nil {
+			return err
+		}
+		digestKey, digest, err := digestSet(headers)
+		if err != nil {
+			return err
+		}
+		defer digestKey.release()
+		for _, h := range headers {
+			h.KeyID = id
+		}
+		keys, err := setKeys(name, headers, opts)
+		if err != nil {
+			return err
+		}
+		r = io.MultiReader(bytes.NewReader(digestKey.bytes()), io.TeeReader(r, digest))
+		return writeSet(name, headers, keys, digest, func(writers []*shardWriter) error {
+			return splitPolicy(r, opts.Policy, headers[0].Block, writers)
+		})
+	}
+
+	if len(opts.Holders) > 0 {
+		parts = 0
+		for _, h := range opts.Holders {
+			parts += h.Weight
+		}
+	}
+	if threshold < 2 || threshold > parts {
+		return errInvalidThreshold
+	}
+
+	xs, err := randomIndexes(f, parts, nil)
 	if err != nil {
 		return err
 	}
 
-	shardNames, err := writeShards(file, shards)
+	headers, err := newSet(f, xs, opts.Holders, threshold, int(length))
 	if err != nil {
 		return err
 	}
+	digestKey, digest, err := digestSet(headers)
+	if err != nil {
+		return err
+	}
+	defer digestKey.release()
+	for _, h := range headers {
+		h.KeyID = id
+	}
+	keys, err := setKeys(name, headers, opts)
+	if err != nil {
+		return err
+	}
+
+	// the digest key is shared ahead of the secret, so that the digest can only be checked once the set is combined
+	r = io.MultiReader(bytes.NewReader(digestKey.bytes()), io.TeeReader(r, digest))
+
+	// compact sets share a random key, and spread the digest key and secret sealed with it
+	var key []byte
+	unit := f.size()
+	if opts.Compact {
+		buf := newSecureBuffer(keySize)
+		defer buf.release()
+		key = buf.bytes()
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+
+		gcm, err := newGCM(key)
+		if err != nil {
+			return err
+		}
+		shared := digestKeySize + length
+		r, err = newSealReader(gcm, r, shared)
+		if err != nil {
+			return err
+		}
+
+		for _, h := range headers {
+			h.Dispersed = int(sealedLength(gcm, shared))
+			h.Chunk = streamChunk
+		}
+		unit *= threshold
+	}
+
+	return writeSet(name, headers, keys, digest, func(writers []*shardWriter) error {
+		if key != nil {
+			shares, err := splitField(f, key, xs, threshold)
+			if err != nil {
+				return err
+			}
+			if err := dealShares(writers, shares); err != nil {
+				return err
+			}
+		}
+
+		buf := newSecureBuffer(headers[0].Block * unit)
+		defer buf.release()
+		block := buf.bytes()
+		for {
+			n, err := io.ReadFull(r, block)
+			if err == io.EOF {
+				return nil
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+
+			// pad the last block to a whole number of elements
+			padded := (n + unit - 1) / unit * unit
+			for i := n; i < padded; i++ {
+				block[i] = 0
+			}
+
+			var shares [][]byte
+			if key != nil {
+				shares = disperse(f, block[:padded], xs, threshold)
+			} else {
+				shares, err = splitField(f, block[:padded], xs, threshold)
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := dealShares(writers, shares); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// setKeys returns the keys that the shards of a new set are sealed with, which are nil unless they're protected
+func setKeys(name string, headers []*shardHeader, opts SplitOptions) ([][]byte, error) {
+	if !opts.Protect {
+		return make([][]byte, len(headers)), nil
+	}
+	return protectShards(name, headers)
+}
+
+// splitPolicy shares the secret in r a block at a time, following the policy
+func splitPolicy(r io.Reader, policy *Policy, size int, writers []*shardWriter) error {
+	holders := policy.holders()
+	buf := newSecureBuffer(size)
+	defer buf.release()
+	block := buf.bytes()
+	for {
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		shares := map[string][]policyShare{}
+		if err := policy.share(block[:n], nil, shares); err != nil {
+			return err
+		}
+
+		// holders can be dealt the same share, so none are wiped until they've all been written
+		var dealt [][]byte
+		for i, h := range holders {
+			values := make([][]byte, len(shares[h]))
+			for k, s := range shares[h] {
+				values[k] = s.value
+			}
+			dealt = append(dealt, values...)
+			if err := writers[i].write(values); err != nil {
+				wipeAll(dealt)
+				return err
+			}
+		}
+		wipeAll(dealt)
+	}
+}
+
+// dealShares hands out the next part of each share to the shards, in order, and wipes the shares once they've been
+// handed out
+func dealShares(writers []*shardWriter, shares [][]byte) error {
+	defer wipeAll(shares)
+	for _, w := range writers {
+		n := len(w.pending)
+		if err := w.write(shares[:n]); err != nil {
+			return err
+		}
+		shares = shares[n:]
+	}
+	return nil
+}
+
+// writeSet creates the shard files of a new set using name as the base file name, sealed with keys, and fills them
+// with fill. Once fill is done, every header records the digest of the secret. If anything goes wrong, none of the set
+// is left behind.
+func writeSet(name string, headers []*shardHeader, keys [][]byte, digest hash.Hash,
+	fill func([]*shardWriter) error) error {
+	writers := make([]*shardWriter, 0, len(headers))
+	for i, h := range headers {
+		w, err := createShard(shardName(name, h), h, keys[i])
+		if err != nil {
+			for _, w := range writers {
+				w.abort()
+			}
+			wipeAll(keys)
+			return err
+		}
+		writers = append(writers, w)
+	}
+	wipeAll(keys)
+
+	err := fill(writers)
+	if err == nil {
+		sum := digest.Sum(nil)
+		for _, h := range headers {
+			copy(h.Digest, sum)
+		}
+	}
+	for _, w := range writers {
+		if err != nil {
+			break
+		}
+		err = w.close()
+	}
+	if err != nil {
+		for _, w := range writers {
+			w.abort()
+		}
+		return err
+	}
 
 	fmt.Println("Successfully wrote shards:")
-	for _, f := range shardNames {
-		fmt.Println(" ", f)
+	for _, w := range writers {
+		fmt.Println(" ", w.path)
 	}
 	fmt.Print("\n")
 
 	return nil
 }
 
-// Merge reads the files, and writes the recovered secret
-func Merge(files []string) error {
-	if len(files) < 2 {
-		return errNotEnoughShards
+// combineShards returns a reader of the secret in the shards, and its length. Reading fails at the end if the secret
+// doesn't match the digest recorded when the set was split.
+func combineShards(files []string, shards []*shard) (io.Reader, int64, error) {
+	secret, length, err := combineSecret(files, shards)
+	if err != nil {
+		return nil, 0, err
 	}
+	secret, err = checkDigest(shards[0].header, secret, length)
+	return secret, length, err
+}
 
-	shards, err := readFiles(files)
+// combineSecret returns a reader of the digest key and secret in the shards, and the length of the secret
+func combineSecret(files []string, shards []*shard) (io.Reader, int64, error) {
+	if h := shards[0].header; h != nil && h.Policy != nil {
+		printMerging(files)
+		secret, err := combinePolicy(shards)
+		return secret, int64(h.Length), err
+	}
+
+	// a single weighted shard may be enough on its own
+	if countShares(shards) < 2 {
+		return nil, 0, errNotEnoughShards
+	}
+
+	err := checkSet(shards)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
+	printMerging(files)
+
+	f := shards[0].field
+	xs := shareXs(shards)
+	length := int64(shards[0].length)
+	threshold := len(xs)
+	if h := shards[0].header; h != nil {
+		threshold = h.Threshold
+		if h.Dispersed > 0 {
+			secret, err := combineCompact(shards)
+			return secret, length, err
+		}
+	}
+
+	weights := lagrangeWeights(f, xs[:threshold], 0)
+	block := blockSymbols(f, len(xs))
+	secret := &pieceReader{secret: true, next: func() ([]byte, error) {
+		ys, err := readShares(shards, block*f.size())
+		if err != nil {
+			return nil, err
+		}
+		defer wipeAll(ys)
+		return weightedSum(f, weights, ys[:threshold]), nil
+	}}
+
+	// wider fields pad the secret to a whole number of elements
+	return &lengthReader{r: secret, left: digestPrefix(shards[0].header) + length}, length, nil
+}
+
+// combineCompact returns a reader of the digest key and secret in the shards of a compact set
+func combineCompact(shards []*shard) (io.Reader, error) {
+	f := shards[0].field
+	h := shards[0].header
+	xs := shareXs(shards)[:h.Threshold]
+
+	keyShares, err := readShares(shards, keySize)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	key := combineField(f, xs, keyShares[:h.Threshold])
+	gcm, err := newGCM(key)
+	wipe(key)
+	wipeAll(keyShares)
+	if err != nil {
+		return nil, err
+	}
+
+	basis := lagrangeBasis(f, xs)
+	block := blockSymbols(f, countShares(shards))
+	ciphertext := &lengthReader{left: int64(h.Dispersed), r: &pieceReader{next: func() ([]byte, error) {
+		ys, err := readShares(shards, block*f.size())
+		if err != nil {
+			return nil, err
+		}
+		return gather(f, basis, ys[:h.Threshold]), nil
+	}}}
+
+	shared := digestPrefix(h) + int64(h.Length)
+	if h.Chunk != streamChunk || int64(h.Dispersed) != sealedLength(gcm, shared) {
+		return nil, errInvalidShard(shards[0].path)
+	}
+	return &lengthReader{r: newOpenReader(gcm, ciphertext, shared, nil, nil), left: shared}, nil
+}
+
+// printMerging lists the shard files being merged
+func printMerging(files []string) {
 	fmt.Println("Merging shards:")
 	for _, f := range files {
 		fmt.Println(" ", filepath.Base(f))
 	}
 	fmt.Print("\n")
+}
+
+// mergedName strips the shard extension from the first file, giving the name of the original file
+func mergedName(files []string) string {
+	parts := strings.Split(files[0], ".")
+	return strings.Join(parts[0:len(parts)-1], ".")
+}
 
-	result, err := shamir.Combine(shards)
+// EncryptOptions changes how a file is encrypted
+type EncryptOptions struct {
+	// Parity writes a parity file alongside the encrypted file, this percentage of its size, which Repair can use
+	// to fix damage to the encrypted file
+	Parity int
+	// Cipher is the name of the cipher to encrypt with, from Ciphers. AES-256-GCM is used by default.
+	Cipher string
+	// Compression is the name of the compression to apply before encrypting, from Compressions. Files aren't
+	// compressed by default.
+	Compression string
+}
+
+// encryptHeader is the metadata written on the first line of an encrypted file. Files written before version 2 have
+// no header, and hold a nonce followed by the whole file sealed at once.
+type encryptHeader struct {
+	Version int `json:"version"`
+	// Length of the plaintext, or -1 if it wasn't known when the file was sealed, in which case it follows from the
+	// length of the file
+	Length int64 `json:"length"`
+	// Chunk is the size of the chunks the plaintext is sealed in
+	Chunk int `json:"chunk"`
+	// Cipher is the name of the cipher the file was sealed with
+	Cipher string `json:"cipher,omitempty"`
+	// Salt is mixed with the master key to derive the file's own key
+	Salt []byte `json:"salt,omitempty"`
+	// Metadata holds the original file's name, permissions and modification time, sealed
+	Metadata []byte `json:"metadata,omitempty"`
+	// Archive is the format of the archive the plaintext holds, if a whole directory was encrypted
+	Archive string `json:"archive,omitempty"`
+	// Compression is the name of the compression applied before sealing
+	Compression string `json:"compression,omitempty"`
+	// Created is when the file was encrypted
+	Created *time.Time `json:"created,omitempty"`
+	// KeyID is the ID of the master key the file was encrypted with
+	KeyID string `json:"keyid,omitempty"`
+}
+
+// DecryptOptions changes how a file is decrypted
+type DecryptOptions struct {
+	// IgnoreMetadata decrypts next to the encrypted file, without its .shush extension, and with 0600 permissions,
+	// instead of restoring the original file's name, permissions and modification time
+	IgnoreMetadata bool
+	// Extract unpacks an encrypted directory, instead of writing out its archive
+	Extract bool
+}
+
+// Encrypt run aes encryption on file, using the key in keyFile. The file is sealed in chunks, across all of our
+// cores.
+func Encrypt(keyFile string, file string, opts EncryptOptions) error {
+	in, err := os.Open(file)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	parts := strings.Split(files[0], ".")
-	dst := strings.Join(parts[0:len(parts)-1], ".")
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errIsDirectory(file)
+	}
+
+	header := &encryptHeader{Length: info.Size()}
+	return encrypt(keyFile, in, info, header, fmt.Sprintf("%s%s", file, encryptExt), opts)
+}
 
-	err = safeWrite(dst, result, 0600)
+// encrypt seals the plaintext in r to dst, along with header and the metadata in info
+func encrypt(keyFile string, r io.Reader, info os.FileInfo, header *encryptHeader, dst string,
+	opts EncryptOptions) error {
+	masterKey, err := readKey(keyFile)
 	if err != nil {
 		return err
 	}
+	defer masterKey.release()
+	master := masterKey.bytes()
 
-	fmt.Printf("Wrote result to %s\n\n", dst)
+	if opts.Cipher == "" {
+		opts.Cipher = Ciphers[0]
+	}
 
-	return nil
-}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, err := fileKey(master, salt)
+	if err != nil {
+		return err
+	}
 
-// Encrypt run aes encryption on file, using the key in keyFile
-func Encrypt(keyFile string, file string) error {
-	gcm, err := getGCM(keyFile)
+	aead, err := newCipher(opts.Cipher, key)
+	wipe(key)
 	if err != nil {
 		return err
 	}
 
-	plaintext, err := ioutil.ReadFile(file)
+	meta, err := sealMetadata(master, salt, opts.Cipher, info)
+	if err != nil {
+		return err
+	}
+	id, err := keyID(master)
 	if err != nil {
 		return err
 	}
 
-	nonce := make([]byte, 12)
-	if _, err := rand.Read(nonce); err != nil {
+	if opts.Compression != "" {
+		compressed, err := compressReader(opts.Compression, r)
+		if err != nil {
+			return err
+		}
+		defer compressed.Close()
+
+		r = compressed
+		header.Length = -1
+	}
+
+	// the header is authenticated along with every chunk
+	header.Version = encryptVersion
+	header.Chunk = streamChunk
+	header.Cipher = opts.Cipher
+	header.Salt = salt
+	header.Metadata = meta
+	header.Compression = opts.Compression
+	header.Created = created()
+	header.KeyID = id
+	line, err := json.Marshal(header)
+	if err != nil {
 		return err
 	}
+	line = append(line, '\n')
 
-	dst := fmt.Sprintf("%s%s", file, encryptExt)
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	out, err := safeCreate(dst, 0600)
+	if err != nil {
+		return err
+	}
 
-	err = safeWrite(dst, ciphertext, 0600)
+	_, err = out.Write(line)
+	if err == nil {
+		err = sealStream(aead, line, r, out, header.Length)
+	}
 	if err != nil {
+		out.abort()
 		return err
 	}
+	if err := out.commit(); err != nil {
+		return err
+	}
+
+	if opts.Parity > 0 {
+		err = writeParity(dst, opts.Parity)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Successfully created %s%s\n", dst, parityExt)
+	}
 
 	fmt.Printf("Successfully created %s\n", dst)
 	return nil
 }
 
-// Decrypt decrypts a file that was encrypted with Encrypt, using the key in keyFile
-func Decrypt(keyFile string, src string) error {
-	gcm, err := getGCM(keyFile)
+// Decrypt decrypts a file that was encrypted with Encrypt, using the key in keyFile. The original file's name,
+// permissions and modification time are restored, if they were recorded.
+func Decrypt(keyFile string, src string, opts DecryptOptions) error {
+	masterKey, err := readKey(keyFile)
 	if err != nil {
 		return err
 	}
+	defer masterKey.release()
+	master := masterKey.bytes()
 
-	ciphertext, err := ioutil.ReadFile(src)
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	if len(ciphertext) < nonceSize {
-		return errNotShushEncrypted
+	r := bufio.NewReader(in)
+	header, ad, err := readEncryptHeader(r)
+	if err != nil {
+		return err
 	}
 
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	if header == nil {
+		if opts.Extract {
+			return errNotArchive
+		}
+		return decryptLegacy(master, r, src, decryptedName(src, nil))
+	}
+	if opts.Extract && header.Archive == "" {
+		return errNotArchive
+	}
 
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	aead, err := fileCipher(master, header)
+	if err != nil {
+		return err
+	}
+
+	meta, err := openMetadata(master, header)
+	if err != nil {
+		return err
+	}
+	if opts.IgnoreMetadata {
+		meta = nil
+	}
+	dst := decryptedName(src, meta)
+
+	if opts.Extract {
+		err = openPlaintext(aead, ad, r, header, func(plaintext io.Reader) error {
+			return extractArchive(plaintext, dst)
+		})
+		if err != nil {
+			return damaged(src, err)
+		}
+		if meta != nil {
+			err = restoreMetadata(dst, meta)
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Successfully extracted to %s\n", dst)
+		return nil
+	}
+
+	// an archive is written out as it is, since its permissions aren't the directory's
+	if header.Archive != "" {
+		dst += "." + header.Archive
+		meta = nil
+	}
+
+	out, err := safeCreate(dst, 0600)
 	if err != nil {
 		return err
 	}
 
-	dst := src[:len(src)-len(encryptExt)]
+	err = openPlaintext(aead, ad, r, header, func(plaintext io.Reader) error {
+		_, err := io.Copy(out, plaintext)
+		return err
+	})
+	if err != nil {
+		out.abort()
+		return damaged(src, err)
+	}
+	if err := out.commit(); err != nil {
+		return err
+	}
+
+	if meta != nil {
+		err = restoreMetadata(dst, meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Successfully decrypted to %s\n", dst)
+
+	return nil
+}
+
+// openPlaintext opens the stream in r, and hands its decompressed plaintext to use. Every chunk is opened before
+// openPlaintext returns, even those that use didn't read, so that nothing is trusted before all of it is checked.
+func openPlaintext(aead cipher.AEAD, ad []byte, r io.Reader, header *encryptHeader, use func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	opened := make(chan error, 1)
+	go func() {
+		err := openStream(aead, ad, r, pw, header.Length)
+		pw.CloseWithError(err)
+		opened <- err
+	}()
+
+	plaintext, err := decompressReader(header.Compression, pr)
+	if err == nil {
+		err = use(plaintext)
+		plaintext.Close()
+	}
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	if err != nil {
+		pr.CloseWithError(err)
+	}
+
+	// a stream that failed to open explains the failure better than whatever was reading it
+	if e := <-opened; e != nil {
+		return e
+	}
+	return err
+}
+
+// decryptLegacy decrypts a file written before shush sealed in chunks, which always used AES-GCM
+func decryptLegacy(key []byte, r io.Reader, src string, dst string) error {
+	plaintext, err := openLegacy(key, r)
+	if err != nil {
+		return damaged(src, err)
+	}
+
 	err = safeWrite(dst, plaintext, 0600)
 	if err != nil {
 		return err
@@ -171,61 +961,95 @@ func Decrypt(keyFile string, src string) error {
 	return nil
 }
 
-// returns GCM for encrypt/decrypt
-func getGCM(keyFile string) (cipher.AEAD, error) {
-	b64key, err := ioutil.ReadFile(keyFile)
+// openLegacy opens a file written before shush sealed in chunks, which is read into memory
+func openLegacy(key []byte, r io.Reader) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
-	key := base64decode(b64key)
-	if len(key) != keySize {
-		return nil, errInvalidKey
+	if len(ciphertext) < nonceSize {
+		return nil, errNotShushEncrypted
 	}
 
-	block, err := aes.NewCipher(key)
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return nil, err
+		return nil, authError{err}
 	}
+	return plaintext, nil
+}
 
-	return cipher.NewGCM(block)
+// damaged explains a failure to decrypt src. Damage looks just like the wrong key, but if there's parity we can check.
+// Only a stream that failed to open or ended early can be damaged, so anything else, like a failure to write the
+// plaintext, is passed on as it is.
+func damaged(src string, err error) error {
+	var auth authError
+	if !errors.As(err, &auth) && err != errTruncated && err != errTrailingData && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, e := os.Stat(src + parityExt); e == nil {
+		return errDamaged(src)
+	}
+	return err
 }
 
-// file reading and writing stuff
-func writeShards(originalFileName string, shards [][]byte) (shardFiles []string, err error) {
-	shardFiles = make([]string, len(shards))
-	for i, shard := range shards {
-		shardFiles[i] = fmt.Sprintf("%s%s%d", originalFileName, shardExt, i)
-		err = safeWrite(shardFiles[i], base64encode(shard), 0600)
-		if err != nil {
-			return nil, err
-		}
+// readEncryptHeader reads the header at the start of r, and returns it along with the header line itself, which
+// every chunk authenticates. Files written before version 2 have no header, and are left untouched.
+func readEncryptHeader(r *bufio.Reader) (*encryptHeader, []byte, error) {
+	// the random nonce at the start of an old file is vanishingly unlikely to look like a header
+	start := []byte(`{"version":`)
+	if b, _ := r.Peek(len(start)); !bytes.Equal(b, start) {
+		return nil, nil, nil
 	}
-	return
+
+	line, err := readHeaderLine(r)
+	if err != nil {
+		return nil, nil, errNotShushEncrypted
+	}
+	header := &encryptHeader{}
+	if err := json.Unmarshal(line, header); err != nil {
+		return nil, nil, errNotShushEncrypted
+	}
+	if header.Version != encryptVersion {
+		return nil, nil, errUnsupportedFile(header.Version)
+	}
+	if header.Chunk != streamChunk || header.Length < -1 {
+		return nil, nil, errNotShushEncrypted
+	}
+	return header, line, nil
 }
 
-// readFiles returns a slice of byte slices
-func readFiles(files []string) (shards [][]byte, err error) {
-	shards = make([][]byte, len(files))
-	for i, f := range files {
-		shard, err := ioutil.ReadFile(f)
-		if err != nil {
-			return nil, err
+// readHeaderLine reads a header line from r, newline included. Headers grow with the metadata sealed into them, like
+// long file names, so they're read up to maxHeaderLine rather than whatever r happens to buffer.
+func readHeaderLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > maxHeaderLine {
+			return nil, errNotShushEncrypted
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
 		}
-
-		shards[i] = base64decode(shard)
 	}
-	return
 }
 
-// safeWrite throws errors if the file already exists
-func safeWrite(path string, data []byte, perms os.FileMode) (err error) {
-	_, e := os.Stat(path)
-	if e != nil && os.IsNotExist(e) {
-		return ioutil.WriteFile(path, data, perms)
+// returns the key for encrypt/decrypt, which has to be released
+func readKey(keyFile string) (*secureBuffer, error) {
+	contents, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
 	}
+	defer wipe(contents)
 
-	return errFileExists(path)
+	return parseKey(contents)
 }
 
 // encoding and decoding helpers
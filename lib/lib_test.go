@@ -1,9 +1,17 @@
 package lib
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 var testFiles = []string{
@@ -12,22 +20,63 @@ var testFiles = []string{
 	"test.key.shard1",
 	"test.key.shard2",
 	"test.key.shard3",
+	"test.key.shard4",
+	"test.key.shard5",
+	"test.key.shard-cto",
+	"test.key.shard-cfo",
+	"test.key.shard-eng1",
+	"test.key.shard-eng2",
+	"new.key",
+	"new.key.shard0",
+	"new.key.shard1",
+	"new.key.shard2",
+	"new.key.shard3",
+	"new.key.shard4",
+	"policy.json",
 	"data.txt",
 	"data.txt.shush",
+	"data.txt.shush.parity",
+	"opaque.bin",
+	"opaque.bin.decrypted",
+	"secrets",
+	"secrets.shush",
+	"secrets.shush.parity",
+	"secrets.tar",
+	"evil",
+	"drill.json",
 }
 
 func deleteTestFiles() {
 	for _, f := range testFiles {
+		os.RemoveAll(f)
+	}
+
+	// some tests write more shards than we'd like to list
+	shards, _ := filepath.Glob("*.shard*")
+	tmp, _ := filepath.Glob(".*.tmp")
+	for _, f := range append(shards, tmp...) {
 		os.Remove(f)
 	}
 }
 
+// testKey reads the key in path, and releases it once the test is done
+func testKey(t *testing.T, path string) []byte {
+	t.Helper()
+
+	key, err := readKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(key.release)
+	return key.bytes()
+}
+
 func TestGen_Split_Merge(t *testing.T) {
 	t.Cleanup(deleteTestFiles)
 	deleteTestFiles()
 
 	// generate a fresh key
-	err := Gen("test.key")
+	err := Gen("test.key", GenOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,7 +88,7 @@ func TestGen_Split_Merge(t *testing.T) {
 	}
 
 	// generate shards
-	err = Split("test.key", 4, 2)
+	err = Split("test.key", 4, 2, SplitOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,14 +112,489 @@ func TestGen_Split_Merge(t *testing.T) {
 	}
 }
 
+func TestReshare(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Split("test.key", 4, 2, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resharing next to the original set would overwrite its shards
+	err = Reshare([]string{"test.key.shard0", "test.key.shard1"}, "", 5, 3, SplitOptions{})
+	if err == nil {
+		t.Fatal("expected reshare to refuse to overwrite existing shards")
+	}
+	os.Remove("test.key")
+
+	// move from 2 of 4 to 3 of 5
+	err = Reshare([]string{"test.key.shard1", "test.key.shard3"}, "new.key", 5, 3, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the secret itself should never have touched the disk
+	if _, err := os.Stat("new.key"); !os.IsNotExist(err) {
+		t.Fatal("reshare wrote the secret to disk")
+	}
+
+	// two shards are no longer enough
+	err = Merge([]string{"new.key.shard0", "new.key.shard4"})
+	if err == nil {
+		t.Fatal("merged with fewer shards than the new threshold")
+	}
+
+	err = Merge([]string{"new.key.shard0", "new.key.shard2", "new.key.shard4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := ioutil.ReadFile("new.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recovered) != string(original) {
+		t.Fatalf("%s (original) does not equal %s", original, recovered)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Split("test.key", 4, 3, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("test.key")
+
+	// a new shard needs a threshold of the existing ones
+	err = Extend([]string{"test.key.shard0", "test.key.shard1"})
+	if err == nil {
+		t.Fatal("extended a set with fewer shards than the threshold")
+	}
+
+	err = Extend([]string{"test.key.shard0", "test.key.shard1", "test.key.shard2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// extend again, using the new shard
+	err = Extend([]string{"test.key.shard4", "test.key.shard3", "test.key.shard2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new shards work alongside the old ones
+	err = Merge([]string{"test.key.shard5", "test.key.shard4", "test.key.shard0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(recovered) != string(original) {
+		t.Fatalf("%s (original) does not equal %s", original, recovered)
+	}
+
+	// extending from the same shards again steers clear of the shards already issued next to them
+	err = Extend([]string{"test.key.shard0", "test.key.shard1", "test.key.shard2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int]bool{}
+	for _, name := range []string{"test.key.shard4", "test.key.shard5", "test.key.shard6"} {
+		s, err := openShard(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+		if seen[s.header.Xs[0]] {
+			t.Fatalf("%s reuses the share of another shard", name)
+		}
+		seen[s.header.Xs[0]] = true
+	}
+	os.Remove("test.key")
+	err = Merge([]string{"test.key.shard6", "test.key.shard5", "test.key.shard4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidThreshold(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Split("test.key", 3, 2, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("test.key")
+
+	// a damaged threshold is refused, rather than used to pick the shares
+	for _, threshold := range []int{-1, 0, 256} {
+		for _, name := range []string{"test.key.shard0", "test.key.shard1"} {
+			contents, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := bytes.IndexByte(contents, '\n')
+			h := &shardHeader{}
+			if err := json.Unmarshal(contents[:i], h); err != nil {
+				t.Fatal(err)
+			}
+			h.Threshold = threshold
+			line, _ := json.Marshal(h)
+			err = ioutil.WriteFile("damaged."+name, append(line, contents[i:]...), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = Merge([]string{"damaged.test.key.shard0", "damaged.test.key.shard1"})
+		if err == nil || err.Error() != errInvalidShard("damaged.test.key.shard0").Error() {
+			t.Fatalf("threshold %d: expected an invalid shard, got %v", threshold, err)
+		}
+	}
+}
+
 const testData = "this is my test data!"
 
+func TestWeightedHolders(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holders, err := ParseHolders("cto:3,cfo:2,eng1,eng2:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Split("test.key", 0, 4, SplitOptions{Holders: holders})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("test.key")
+
+	// 2 + 1 shares isn't enough
+	err = Merge([]string{"test.key.shard-cfo", "test.key.shard-eng1"})
+	if err == nil {
+		t.Fatal("merged with fewer shares than the threshold")
+	}
+
+	for _, files := range [][]string{
+		{"test.key.shard-cto", "test.key.shard-eng2"},
+		{"test.key.shard-cfo", "test.key.shard-eng1", "test.key.shard-eng2"},
+	} {
+		err = Merge(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recovered, err := ioutil.ReadFile("test.key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(recovered) != string(original) {
+			t.Fatalf("%s (original) does not equal %s", original, recovered)
+		}
+		os.Remove("test.key")
+	}
+}
+
+func TestParseHolders(t *testing.T) {
+	for _, list := range []string{"cto:0", "cto:x", "../cto:1", "cto,cto", ""} {
+		if _, err := ParseHolders(list); err == nil {
+			t.Fatalf("expected %q to be invalid", list)
+		}
+	}
+}
+
+const testPolicy = `{"threshold": 2, "groups": [
+	{"name": "legal", "threshold": 2, "members": ["alice", "bob", "carol", "dave"]},
+	{"name": "execs", "threshold": 3, "members": ["erin", "frank", "grace", "heidi", "alice"]},
+	{"name": "ops", "threshold": 1, "members": ["ivan", "judy"]}
+]}`
+
+func TestPolicy(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile("policy.json", []byte(testPolicy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy("policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Split("test.key", 0, 0, SplitOptions{Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("test.key")
+
+	// only legal is satisfied
+	err = Merge([]string{"test.key.shard-alice", "test.key.shard-bob", "test.key.shard-erin"})
+	if err != errPolicyNotSatisfied {
+		t.Fatal("expected the policy not to be satisfied, got", err)
+	}
+
+	for _, files := range [][]string{
+		{"test.key.shard-alice", "test.key.shard-bob", "test.key.shard-judy"},
+		{"test.key.shard-alice", "test.key.shard-erin", "test.key.shard-frank", "test.key.shard-ivan"},
+	} {
+		err = Merge(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recovered, err := ioutil.ReadFile("test.key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(recovered) != string(original) {
+			t.Fatalf("%s (original) does not equal %s", original, recovered)
+		}
+		os.Remove("test.key")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+
+	original := make([]byte, 30000)
+	rand.Read(original)
+
+	for _, field := range Fields {
+		deleteTestFiles()
+
+		err := ioutil.WriteFile("data.txt", original, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Split("data.txt", 5, 3, SplitOptions{Field: field, Compact: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove("data.txt")
+
+		// each shard should be about a third of the secret
+		info, err := os.Stat("data.txt.shard0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > int64(len(original))/3+1024 {
+			t.Fatalf("%s: shard is %d bytes, for a %d byte secret", field, info.Size(), len(original))
+		}
+
+		err = Extend([]string{"data.txt.shard4", "data.txt.shard1", "data.txt.shard2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Merge([]string{"data.txt.shard5", "data.txt.shard3", "data.txt.shard0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := ioutil.ReadFile("data.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, original) {
+			t.Fatalf("%s: recovered data doesn't match", field)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+
+	// enough shards that the secret takes several blocks, and several chunks when compact
+	original := make([]byte, 300000)
+	rand.Read(original)
+
+	for _, opts := range []SplitOptions{{}, {Field: "gf65536"}, {Compact: true}} {
+		deleteTestFiles()
+
+		err := ioutil.WriteFile("data.txt", original, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Split("data.txt", 100, 3, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove("data.txt")
+
+		// a shard that was cut short can't be merged, and leaves nothing behind
+		contents, err := ioutil.ReadFile("data.txt.shard7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile("data.txt.shard7", contents[:len(contents)-100], 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Merge([]string{"data.txt.shard7", "data.txt.shard50", "data.txt.shard99"})
+		if err == nil {
+			t.Fatalf("%+v: merged a truncated shard", opts)
+		}
+		if _, err := os.Stat("data.txt"); !os.IsNotExist(err) {
+			t.Fatalf("%+v: left a partial secret behind", opts)
+		}
+
+		err = Merge([]string{"data.txt.shard8", "data.txt.shard50", "data.txt.shard99"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := ioutil.ReadFile("data.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, original) {
+			t.Fatalf("%+v: recovered data doesn't match", opts)
+		}
+	}
+}
+
+// shards written before shush tracked sets, which have no header
+var legacyShards = map[string]string{
+	// written with hashicorp's shamir package
+	"test.key.shard0": "0a+eWAP06hFKD1/Snn/ADw==",
+	"test.key.shard1": "kW4xg9X6xQABTEe/SrA0vw==",
+	"test.key.shard2": "iWXnyzEzIyV/MUIH6HKahQ==",
+}
+
+func TestLegacyShards(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	for name, contents := range legacyShards {
+		err := ioutil.WriteFile(name, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := Merge([]string{"test.key.shard2", "test.key.shard0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "a legacy secret" {
+		t.Fatalf("recovered %q", result)
+	}
+
+	// without a header, there's nothing to extend the set from
+	err = Extend([]string{"test.key.shard1", "test.key.shard2"})
+	if err != errMissingSetInfo {
+		t.Fatal("expected a legacy set not to be extended, got", err)
+	}
+}
+
+func TestLargeField(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	// an odd length, so that the secret needs padding
+	err := ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Split("data.txt", 300, 3, SplitOptions{})
+	if err == nil {
+		t.Fatal("split into more than 255 shards without a larger field")
+	}
+
+	err = Split("data.txt", 300, 3, SplitOptions{Field: "gf65536"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	err = Extend([]string{"data.txt.shard299", "data.txt.shard7", "data.txt.shard150"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Merge([]string{"data.txt.shard300", "data.txt.shard255", "data.txt.shard0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ioutil.ReadFile("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(result) != testData {
+		t.Fatalf("recovered %q", result)
+	}
+}
+
 func TestEncrypt_Decrypt(t *testing.T) {
 	t.Cleanup(deleteTestFiles)
 	deleteTestFiles()
 
 	// generate a fresh key
-	err := Gen("test.key")
+	err := Gen("test.key", GenOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,7 +606,7 @@ func TestEncrypt_Decrypt(t *testing.T) {
 	}
 
 	// encrypt dummy data
-	err = Encrypt("test.key", "data.txt")
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -94,7 +618,7 @@ func TestEncrypt_Decrypt(t *testing.T) {
 	}
 
 	// try to recover
-	err = Decrypt("test.key", "data.txt.shush")
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,6 +633,426 @@ func TestEncrypt_Decrypt(t *testing.T) {
 	}
 }
 
+func TestCiphers(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := make([]byte, 2*streamChunk+100)
+	rand.Read(original)
+
+	for _, cipher := range Ciphers {
+		err = ioutil.WriteFile("data.txt", original, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Encrypt("test.key", "data.txt", EncryptOptions{Cipher: cipher})
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove("data.txt")
+
+		var part bytes.Buffer
+		err = DecryptRange("test.key", "data.txt.shush", streamChunk-10, 20, &part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(part.Bytes(), original[streamChunk-10:streamChunk+10]) {
+			t.Fatalf("%s: decrypted range doesn't match", cipher)
+		}
+
+		err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := ioutil.ReadFile("data.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, original) {
+			t.Fatalf("%s: decrypted data doesn't match what we encrypted", cipher)
+		}
+
+		os.Remove("data.txt")
+		os.Remove("data.txt.shush")
+	}
+
+	err = ioutil.WriteFile("data.txt", original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Encrypt("test.key", "data.txt", EncryptOptions{Cipher: "rot13"})
+	if err == nil {
+		t.Fatal("encrypted with an unknown cipher")
+	}
+}
+
+func TestEncryptChunks(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough for several chunks, with a short one at the end
+	original := make([]byte, 5*streamChunk+100)
+	rand.Read(original)
+	err = ioutil.WriteFile("data.txt", original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	ciphertext, err := ioutil.ReadFile("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// swapping two chunks, or dropping the last one, is caught
+	header := bytes.IndexByte(ciphertext, '\n') + 1 + nonceSize - streamCounter
+	sealed := streamChunk + tagSize
+	swapped := append([]byte{}, ciphertext...)
+	copy(swapped[header:], ciphertext[header+sealed:header+2*sealed])
+	copy(swapped[header+sealed:], ciphertext[header:header+sealed])
+	for _, damaged := range [][]byte{swapped, ciphertext[:header+5*sealed]} {
+		err = ioutil.WriteFile("data.txt.shush", damaged, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+		if err == nil {
+			t.Fatal("decrypted a damaged file")
+		}
+		if _, err := os.Stat("data.txt"); !os.IsNotExist(err) {
+			t.Fatal("left a partial file behind")
+		}
+	}
+
+	err = ioutil.WriteFile("data.txt.shush", ciphertext, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadFile("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, original) {
+		t.Fatal("decrypted data doesn't match what we encrypted")
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files used to be a nonce, followed by the whole file sealed at once
+	key := testKey(t, "test.key")
+	gcm, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	err = ioutil.WriteFile("data.txt.shush", gcm.Seal(nonce, nonce, []byte(testData), nil), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadFile("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != testData {
+		t.Fatal("decrypted data doesn't match what we encrypted")
+	}
+}
+
+func TestFileKeys(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testKey(t, "test.key")
+
+	// files sealed before each file had its own key used the master key directly
+	header, err := json.Marshal(&encryptHeader{Version: encryptVersion, Length: int64(len(testData)), Chunk: streamChunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header = append(header, '\n')
+	gcm, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed bytes.Buffer
+	sealed.Write(header)
+	err = sealStream(gcm, header, bytes.NewReader([]byte(testData)), &sealed, int64(len(testData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("data.txt.shush", sealed.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadFile("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != testData {
+		t.Fatal("decrypted data doesn't match what we encrypted")
+	}
+	os.Remove("data.txt.shush")
+
+	// new files get a salt, which can't be changed
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	contents, err := ioutil.ReadFile("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.IndexByte(contents, '\n')
+	h := &encryptHeader{}
+	if err := json.Unmarshal(contents[:i], h); err != nil || len(h.Salt) != saltSize {
+		t.Fatalf("expected a salt in %s", contents[:i])
+	}
+
+	h.Salt[0] ^= 1
+	line, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("data.txt.shush", append(append(line, '\n'), contents[i+1:]...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err == nil {
+		t.Fatal("decrypted with the wrong salt")
+	}
+}
+
+func TestKeyIDs(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	for _, name := range []string{"test.key", "new.key"} {
+		if err := Gen(name, GenOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := testKey(t, "test.key")
+	id, err := keyID(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := testKey(t, "new.key")
+	otherID, err := keyID(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 9 || id[4] != '-' || id == otherID {
+		t.Fatalf("unexpected key IDs %s and %s", id, otherID)
+	}
+
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	// the wrong key is named, instead of failing to authenticate
+	err = Decrypt("new.key", "data.txt.shush", DecryptOptions{})
+	if err == nil || err.Error() != errWrongKey(id, otherID).Error() {
+		t.Fatal("expected the wrong key to be named, got", err)
+	}
+
+	// shards of a key record its ID, and other secrets don't have one
+	err = Split("test.key", 3, 2, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Split("data.txt.shush", 3, 2, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"test.key.shard0": id, "data.txt.shush.shard1": ""} {
+		s, err := openShard(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+		if s.header.KeyID != want {
+			t.Fatalf("%s records key %q, expected %q", path, s.header.KeyID, want)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chmod("data.txt", 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("data.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Encrypt("test.key", "data.txt", EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	// the name isn't needed to decrypt it
+	err = os.Rename("data.txt.shush", "opaque.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt("test.key", "opaque.bin", DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("restored %v %v", info.Mode(), info.ModTime())
+	}
+
+	err = Decrypt("test.key", "opaque.bin", DecryptOptions{IgnoreMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat("opaque.bin.decrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected 0600, got %v", info.Mode())
+	}
+}
+
+func TestLongFileName(t *testing.T) {
+	name := strings.Repeat("n", 200) + ".txt"
+	t.Cleanup(func() {
+		os.Remove(name)
+		os.Remove(name + ".shush")
+		deleteTestFiles()
+	})
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name, []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sealed name makes the header longer than a single read of it
+	err = Encrypt("test.key", name, EncryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(name)
+
+	err = Verify("test.key", name+".shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Decrypt("test.key", name+".shush", DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != testData {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+}
+
+// BenchmarkEncrypt seals 64MB with more and more workers, which should scale with the number of cores
+func BenchmarkEncrypt(b *testing.B) {
+	key := make([]byte, keySize)
+	rand.Read(key)
+	gcm, err := newGCM(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	plaintext := make([]byte, 64<<20)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for procs := 1; procs <= runtime.NumCPU(); procs *= 2 {
+		b.Run(fmt.Sprintf("workers=%d", procs), func(b *testing.B) {
+			runtime.GOMAXPROCS(procs)
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				err := sealStream(gcm, nil, bytes.NewReader(plaintext), ioutil.Discard, int64(len(plaintext)))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestBase64Encode(t *testing.T) {
 	result := base64encode([]byte("test"))
 	if string(result) != "dGVzdA==" {
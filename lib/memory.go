@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"io"
+	"sync"
+)
+
+// Keys, passphrases and the shares and secrets that pass through shush are held in secureBuffers where we can. Their
+// memory is mapped outside of the Go heap, so the garbage collector never copies it, and locked into RAM, so it's never
+// written to swap. It's zeroed as soon as it's released, and core dumps are disabled once the first buffer is made, so
+// a crash doesn't write it to disk either. Where memory can't be locked, like past RLIMIT_MEMLOCK or on systems without
+// mlock, buffers still work, and are still zeroed.
+//
+// Go copies data as it's passed around, through ciphers and io.Copy among others, so this narrows how long secrets
+// stay in memory rather than ruling it out.
+
+// secureBuffer is memory for a key or a secret
+type secureBuffer struct {
+	b []byte
+	// mapped is the whole pages backing b, if they were mapped outside of the Go heap
+	mapped []byte
+	locked bool
+}
+
+var coreDumps sync.Once
+
+// newSecureBuffer returns a zeroed buffer of size bytes, which has to be released
+func newSecureBuffer(size int) *secureBuffer {
+	coreDumps.Do(disableCoreDumps)
+
+	if size > 0 {
+		if mapped, locked := allocSecure(size); mapped != nil {
+			return &secureBuffer{b: mapped[:size], mapped: mapped, locked: locked}
+		}
+	}
+	return &secureBuffer{b: make([]byte, size)}
+}
+
+// secureCopy moves b into a new buffer, and zeroes b
+func secureCopy(b []byte) *secureBuffer {
+	s := newSecureBuffer(len(b))
+	copy(s.b, b)
+	wipe(b)
+	return s
+}
+
+// bytes returns the buffer's memory, which can't be used once it's released
+func (s *secureBuffer) bytes() []byte {
+	return s.b
+}
+
+// release zeroes the buffer, and gives its memory back. Releasing it again does nothing.
+func (s *secureBuffer) release() {
+	if s == nil || s.b == nil {
+		return
+	}
+
+	wipe(s.b)
+	if s.mapped != nil {
+		freeSecure(s.mapped, s.locked)
+	}
+	s.b, s.mapped = nil, nil
+}
+
+// readSecret reads the length bytes of a secret from r into a new buffer. Errors that come with the last of the
+// secret, like a digest that doesn't match, aren't dropped.
+func readSecret(r io.Reader, length int) (*secureBuffer, error) {
+	s := newSecureBuffer(length)
+	for n := 0; n < length; {
+		m, err := r.Read(s.b[n:])
+		n += m
+		if err == io.EOF && n == length {
+			break
+		} else if err != nil {
+			s.release()
+			return nil, unexpectedEOF(err)
+		}
+	}
+	return s, nil
+}
+
+// wipe zeroes b
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipeAll zeroes every slice in bs
+func wipeAll(bs [][]byte) {
+	for _, b := range bs {
+		wipe(b)
+	}
+}
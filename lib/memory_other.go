@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package lib
+
+// allocSecure can't map or lock memory on this system, so buffers come from the Go heap, and are only zeroed
+func allocSecure(size int) ([]byte, bool) {
+	return nil, false
+}
+
+func freeSecure(b []byte, locked bool) {}
+
+func disableCoreDumps() {}
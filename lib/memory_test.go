@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSecureBuffer(t *testing.T) {
+	key := []byte("not a very secret key")
+	s := secureCopy(key)
+	if string(s.bytes()) != "not a very secret key" {
+		t.Fatalf("unexpected copy %q", s.bytes())
+	}
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Fatal("the original wasn't wiped")
+	}
+
+	s.release()
+	if s.bytes() != nil {
+		t.Fatal("the buffer can still be used after it's released")
+	}
+	s.release()
+
+	// buffers larger than a page, and empty ones, work too
+	for _, size := range []int{0, 1, 5000, 1 << 20} {
+		s := newSecureBuffer(size)
+		if len(s.bytes()) != size || !bytes.Equal(s.bytes(), make([]byte, size)) {
+			t.Fatalf("expected %d zeroed bytes", size)
+		}
+		s.release()
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	s, err := readSecret(bytes.NewReader([]byte(testData)), len(testData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(s.bytes()) != testData {
+		t.Fatalf("unexpected secret %q", s.bytes())
+	}
+	s.release()
+
+	_, err = readSecret(bytes.NewReader([]byte(testData)), len(testData)+1)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected a short secret to fail, got", err)
+	}
+
+	// an error that comes with the last bytes is kept
+	mismatch := errors.New("mismatch")
+	_, err = readSecret(&lastError{data: []byte(testData), err: mismatch}, len(testData))
+	if err != mismatch {
+		t.Fatal("expected the last error, got", err)
+	}
+}
+
+// lastError reads all of data at once, along with err
+type lastError struct {
+	data []byte
+	err  error
+}
+
+func (l *lastError) Read(b []byte) (int, error) {
+	if len(l.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, l.data)
+	l.data = l.data[n:]
+	return n, l.err
+}
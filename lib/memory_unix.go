@@ -0,0 +1,40 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lib
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocSecure maps whole pages for size bytes, and tries to lock them into RAM. It returns nil if nothing could be
+// mapped.
+func allocSecure(size int) ([]byte, bool) {
+	page := os.Getpagesize()
+	length := (size + page - 1) / page * page
+	b, err := unix.Mmap(-1, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, false
+	}
+	return b, unix.Mlock(b) == nil
+}
+
+// freeSecure unlocks and unmaps pages from allocSecure
+func freeSecure(b []byte, locked bool) {
+	if locked {
+		unix.Munlock(b)
+	}
+	unix.Munmap(b)
+}
+
+// disableCoreDumps stops a crash from writing the process's memory to disk
+func disableCoreDumps() {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &limit); err != nil {
+		return
+	}
+	limit.Cur = 0
+	unix.Setrlimit(unix.RLIMIT_CORE, &limit)
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errInvalidMetadata = errors.New("the file's metadata is damaged, or the key is wrong")
+
+// fileMetadata is what Encrypt records about the original file. It's sealed with a key of its own, derived from the
+// master key and the file's salt, so only holders of the key can read it. The sealed metadata is part of the header,
+// which every chunk authenticates.
+type fileMetadata struct {
+	Name    string      `json:"name"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+// sealMetadata seals the metadata of the file described by info. Each key only ever seals one message, so the
+// nonce can be zero.
+func sealMetadata(key []byte, salt []byte, cipherName string, info os.FileInfo) ([]byte, error) {
+	aead, err := metadataCipher(key, salt, cipherName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := json.Marshal(&fileMetadata{Name: info.Name(), Mode: info.Mode().Perm(), ModTime: info.ModTime()})
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), meta, nil), nil
+}
+
+// openMetadata opens the metadata in header, which files from before shush recorded metadata don't have
+func openMetadata(key []byte, header *encryptHeader) (*fileMetadata, error) {
+	if len(header.Metadata) == 0 {
+		return nil, nil
+	}
+
+	aead, err := metadataCipher(key, header.Salt, header.Cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), header.Metadata, nil)
+	if err != nil {
+		return nil, errInvalidMetadata
+	}
+
+	meta := &fileMetadata{}
+	if err := json.Unmarshal(plaintext, meta); err != nil {
+		return nil, errInvalidMetadata
+	}
+	return meta, nil
+}
+
+// metadataCipher returns the cipher that seals a file's metadata
+func metadataCipher(key []byte, salt []byte, cipherName string) (cipher.AEAD, error) {
+	key, err := deriveKey(key, salt, metadataInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return newCipher(cipherName, key)
+}
+
+// decryptedName picks where to decrypt src to. The original name is used if we have it, but only ever in the same
+// directory as src.
+func decryptedName(src string, meta *fileMetadata) string {
+	if meta != nil {
+		name := filepath.Base(meta.Name)
+		if name != "." && name != ".." && name != string(filepath.Separator) {
+			return filepath.Join(filepath.Dir(src), name)
+		}
+	}
+
+	if strings.HasSuffix(src, encryptExt) {
+		return strings.TrimSuffix(src, encryptExt)
+	}
+	return src + ".decrypted"
+}
+
+// restoreMetadata gives the decrypted file at path its original permissions and modification time
+func restoreMetadata(path string, meta *fileMetadata) error {
+	if err := os.Chmod(path, meta.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(path, meta.ModTime, meta.ModTime)
+}
@@ -0,0 +1,551 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	parityExt     = ".parity"
+	parityVersion = 1
+	// parityBlock is the largest block that parity protects, and parityStripe how many data blocks share parity
+	parityBlock  = 4096
+	parityStripe = 20
+)
+
+var (
+	errInvalidParity     = errors.New("invalid parity percentage; expected 1% to 100%")
+	errParityMismatch    = errors.New("parity file doesn't belong to this file")
+	errInvalidParityFile = func(path string) error { return fmt.Errorf("\"%s\" is not a valid parity file", path) }
+	errTooDamaged        = func(stripes []int) error {
+		return fmt.Errorf("too many damaged blocks to repair %d stripes, which were left as they were: %v",
+			len(stripes), stripes)
+	}
+	errUnrepaired = func(blocks int) error {
+		return fmt.Errorf("%d damaged blocks didn't match their checksums once rebuilt, and were left as they were",
+			blocks)
+	}
+)
+
+// Parity files protect a file with reed-solomon erasure coding. The file is cut into blocks, and every block gets a
+// checksum, so that damaged blocks can be found and treated as missing. Data blocks are dealt round-robin into
+// stripes, so that a run of damaged blocks is spread over many stripes, and each stripe gets parity blocks that
+// can replace up to that many damaged blocks in it.
+//
+// A parity file is a json header line, followed by the parity blocks of each stripe in turn. Every block's checksum is
+// in the header, so the header is checksummed too, and written again at the end of the file, followed by its length
+// as a 4 byte big endian integer. Either copy is enough. Parity is worked out a stripe at a time, reading the blocks
+// it needs from the file, so neither file is ever held in memory.
+
+// parityHeader is the metadata written on the first line of a parity file
+type parityHeader struct {
+	Version int `json:"version"`
+	// Length of the protected file
+	Length int `json:"length"`
+	Block  int `json:"block"`
+	// Data and Parity are the number of data and parity blocks in each stripe
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+	// Checksums holds the crc32 of every data block, followed by every parity block
+	Checksums []byte `json:"checksums"`
+	// Sum is the big endian crc32 of the header, written with a Sum of zeros. It's kept as bytes so that the header is
+	// the same length whatever the checksums are, which lets it be written before they're known.
+	Sum []byte `json:"sum"`
+}
+
+// newParityHeader picks a layout for a file of length bytes, with percent extra for parity
+func newParityHeader(length int, percent int) *parityHeader {
+	// small files get smaller blocks, so that there are still enough of them to make a stripe
+	block := parityBlock
+	if length < parityBlock*parityStripe {
+		block = (length + parityStripe - 1) / parityStripe
+		if block < 64 {
+			block = 64
+		}
+	}
+
+	h := &parityHeader{Version: parityVersion, Length: length, Block: block, Data: parityStripe}
+	if blocks := h.dataBlocks(); blocks < h.Data {
+		h.Data = blocks
+	}
+	h.Parity = (h.Data*percent + 99) / 100
+	return h
+}
+
+// dataBlocks is the number of blocks in the protected file
+func (h *parityHeader) dataBlocks() int {
+	return (h.Length + h.Block - 1) / h.Block
+}
+
+// stripes is the number of stripes the data blocks are dealt into
+func (h *parityHeader) stripes() int {
+	return (h.dataBlocks() + h.Data - 1) / h.Data
+}
+
+// dataBlock returns which block of the file is at position i in stripe s, or -1 if the last stripe isn't full
+func (h *parityHeader) dataBlock(s int, i int) int {
+	b := i*h.stripes() + s
+	if b >= h.dataBlocks() {
+		return -1
+	}
+	return b
+}
+
+// readBlock returns block b of the file in r, padded with zeros to the block size. Anything missing from the end of
+// the file reads as zeros, and is caught by its checksum.
+func (h *parityHeader) readBlock(r io.ReaderAt, b int) ([]byte, error) {
+	out := make([]byte, h.Block)
+	if b < 0 {
+		return out, nil
+	}
+	n := h.Length - b*h.Block
+	if n > h.Block {
+		n = h.Block
+	}
+	if _, err := r.ReadAt(out[:n], int64(b*h.Block)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+// readStripe returns the data blocks of stripe s
+func (h *parityHeader) readStripe(r io.ReaderAt, s int) ([][]byte, error) {
+	blocks := make([][]byte, h.Data)
+	for i := range blocks {
+		block, err := h.readBlock(r, h.dataBlock(s, i))
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = block
+	}
+	return blocks, nil
+}
+
+// cauchy returns the coefficient of data block i in parity block j. Every square matrix made from rows of the
+// identity and this cauchy matrix can be inverted, so any Data blocks of a stripe are enough to rebuild the rest.
+func (h *parityHeader) cauchy(j int, i int) byte {
+	return gfInv(byte(h.Data+j) ^ byte(i))
+}
+
+// checksum returns the stored crc32 of block n, where parity blocks follow the data blocks
+func (h *parityHeader) checksum(n int) uint32 {
+	return binary.BigEndian.Uint32(h.Checksums[4*n:])
+}
+
+// stripeParity returns the parity blocks for the data blocks of a stripe
+func (h *parityHeader) stripeParity(blocks [][]byte) [][]byte {
+	parity := make([][]byte, h.Parity)
+	for j := range parity {
+		parity[j] = make([]byte, h.Block)
+		for i, block := range blocks {
+			gfMulAdd(parity[j], block, h.cauchy(j, i))
+		}
+	}
+	return parity
+}
+
+// write writes a parity file for the file in r to w, a stripe at a time. The header is written first with empty
+// checksums, and again over the top once they're known, which fits since the header's length doesn't depend on them.
+func (h *parityHeader) write(w io.WriterAt, r io.ReaderAt) error {
+	h.Version = parityVersion
+	h.Checksums = make([]byte, 4*(h.dataBlocks()+h.stripes()*h.Parity))
+	line, err := h.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(line, 0); err != nil {
+		return err
+	}
+
+	start := int64(len(line))
+	for s := 0; s < h.stripes(); s++ {
+		blocks, err := h.readStripe(r, s)
+		if err != nil {
+			return err
+		}
+		for i, block := range blocks {
+			if b := h.dataBlock(s, i); b >= 0 {
+				binary.BigEndian.PutUint32(h.Checksums[4*b:], crc32.ChecksumIEEE(block))
+			}
+		}
+
+		for j, p := range h.stripeParity(blocks) {
+			n := s*h.Parity + j
+			binary.BigEndian.PutUint32(h.Checksums[4*(h.dataBlocks()+n):], crc32.ChecksumIEEE(p))
+			if _, err := w.WriteAt(p, start+int64(n*h.Block)); err != nil {
+				return err
+			}
+		}
+	}
+
+	final, err := h.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(final, 0); err != nil {
+		return err
+	}
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(final)))
+	_, err = w.WriteAt(append(final, size...), start+int64(h.stripes()*h.Parity*h.Block))
+	return err
+}
+
+// marshal returns the header line, with its checksum
+func (h *parityHeader) marshal() ([]byte, error) {
+	h.Sum = make([]byte, 4)
+	line, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(h.Sum, crc32.ChecksumIEEE(line))
+	line, err = json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// parseParityHeader returns the header in line, or nil if it's damaged
+func parseParityHeader(line []byte) *parityHeader {
+	h := &parityHeader{}
+	if err := json.Unmarshal(line, h); err != nil || h.Block < 1 || h.Data < 1 || h.Parity < 1 ||
+		h.Data+h.Parity > 256 || h.Length < 0 {
+		return nil
+	}
+	if len(h.Checksums) != 4*(h.dataBlocks()+h.stripes()*h.Parity) {
+		return nil
+	}
+
+	sum := h.Sum
+	if check, err := h.marshal(); err != nil || h.Version != parityVersion || !bytes.Equal(check[:len(check)-1], line) ||
+		!bytes.Equal(h.Sum, sum) {
+		return nil
+	}
+	return h
+}
+
+// parityTrailer returns the copy of the header line at the end of a parity file of size bytes, or nil if there isn't
+// a good one
+func parityTrailer(r io.ReaderAt, size int64) []byte {
+	b := make([]byte, 4)
+	if size < 4 {
+		return nil
+	}
+	if _, err := r.ReadAt(b, size-4); err != nil {
+		return nil
+	}
+	n := int64(binary.BigEndian.Uint32(b))
+	if n < 1 || n > size-4 {
+		return nil
+	}
+	line := make([]byte, n)
+	if _, err := r.ReadAt(line, size-4-n); err != nil {
+		return nil
+	}
+	if line[n-1] != '\n' || parseParityHeader(line[:n-1]) == nil {
+		return nil
+	}
+	return line
+}
+
+// writeParity writes a parity file for the file at path
+func writeParity(path string, percent int) error {
+	if percent < 1 || percent > 100 {
+		return errInvalidParity
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := safeCreate(path+parityExt, 0600)
+	if err != nil {
+		return err
+	}
+	if err := newParityHeader(int(info.Size()), percent).write(out, in); err != nil {
+		out.abort()
+		return err
+	}
+	return out.commit()
+}
+
+// rebuildParity replaces the parity file for the file at path, keeping the layout in h
+func rebuildParity(path string, h *parityHeader) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := replaceCreate(path+parityExt, 0600)
+	if err != nil {
+		return err
+	}
+	if err := h.write(out, in); err != nil {
+		out.abort()
+		return err
+	}
+	return out.commit()
+}
+
+// parityFile is an open parity file, whose parity blocks are read as they're needed
+type parityFile struct {
+	*os.File
+	// start is where the parity blocks begin, after the header
+	start int64
+	// intact is whether every copy of the header was undamaged
+	intact bool
+}
+
+// readParity opens the parity file for path, and returns its header
+func readParity(path string) (*parityHeader, *parityFile, error) {
+	file, err := os.Open(path + parityExt)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	p := &parityFile{File: file}
+
+	var h *parityHeader
+	if line, err := bufio.NewReader(file).ReadBytes('\n'); err == nil {
+		h, p.start = parseParityHeader(line[:len(line)-1]), int64(len(line))
+	}
+	trailer := parityTrailer(file, info.Size())
+	p.intact = h != nil && trailer != nil
+
+	// the copy is the same length as the header, which is how we know where the parity blocks start
+	if h == nil && trailer != nil {
+		h, p.start = parseParityHeader(trailer[:len(trailer)-1]), int64(len(trailer))
+	}
+	if h == nil {
+		file.Close()
+		return nil, nil, errInvalidParityFile(path + parityExt)
+	}
+	return h, p, nil
+}
+
+// block returns parity block n. Damaged parity blocks are caught by their checksums, but a short file has lost them
+// altogether, so they read as zeros.
+func (p *parityFile) block(h *parityHeader, n int) ([]byte, error) {
+	out := make([]byte, h.Block)
+	if _, err := p.ReadAt(out, p.start+int64(n*h.Block)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Repair uses the parity file written alongside file to fix any damaged blocks, and rewrites both files if needed.
+// Stripes with too much damage are left as they were, and listed once the rest of the file has been repaired.
+func Repair(file string) error {
+	h, parity, err := readParity(file)
+	if err != nil {
+		return err
+	}
+	defer parity.Close()
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the file is only copied to be rewritten once there's something to fix. Missing data is just more damage, and
+	// anything past the end is junk.
+	var out *newFile
+	defer func() {
+		if out != nil {
+			out.abort()
+		}
+	}()
+	rewrite := func() error {
+		if out != nil {
+			return nil
+		}
+		out, err = replaceCreate(file, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, io.NewSectionReader(in, 0, int64(h.Length))); err != nil {
+			return err
+		}
+		return out.Truncate(int64(h.Length))
+	}
+	if info.Size() != int64(h.Length) {
+		if err := rewrite(); err != nil {
+			return err
+		}
+	}
+
+	repaired, unrepaired, damagedParity := 0, 0, 0
+	var tooDamaged []int
+	for s := 0; s < h.stripes(); s++ {
+		r, err := h.repairStripe(in, parity, s)
+		if err != nil {
+			return err
+		}
+		if r.tooDamaged {
+			tooDamaged = append(tooDamaged, s)
+		}
+		unrepaired += r.unrepaired
+		damagedParity += r.damagedParity
+
+		for b, block := range r.blocks {
+			if err := rewrite(); err != nil {
+				return err
+			}
+			n := h.Length - b*h.Block
+			if n > h.Block {
+				n = h.Block
+			}
+			if _, err := out.WriteAt(block[:n], int64(b*h.Block)); err != nil {
+				return err
+			}
+			repaired++
+		}
+	}
+
+	if out == nil && damagedParity == 0 && parity.intact && unrepaired == 0 && len(tooDamaged) == 0 {
+		fmt.Printf("No damage found in %s\n", file)
+		return nil
+	}
+
+	if out != nil {
+		if err := out.commit(); err != nil {
+			return err
+		}
+		if repaired > 0 {
+			fmt.Printf("Repaired %d damaged blocks\n", repaired)
+		}
+	}
+
+	// parity worked out from data that's still damaged would bake the damage in, so it's only rebuilt from a whole file
+	if (damagedParity > 0 || !parity.intact) && unrepaired == 0 && len(tooDamaged) == 0 {
+		if damagedParity > 0 {
+			fmt.Printf("Rebuilt %d damaged parity blocks\n", damagedParity)
+		}
+		if !parity.intact {
+			fmt.Println("Rebuilt the damaged parity header")
+		}
+		if err := rebuildParity(file, h); err != nil {
+			return err
+		}
+	}
+
+	if len(tooDamaged) > 0 {
+		return errTooDamaged(tooDamaged)
+	}
+	if unrepaired > 0 {
+		return errUnrepaired(unrepaired)
+	}
+	fmt.Printf("Successfully repaired %s\n", file)
+	return nil
+}
+
+// stripeRepair is what repairing a stripe found
+type stripeRepair struct {
+	// blocks holds the rebuilt data blocks, by their position in the file
+	blocks map[int][]byte
+	// unrepaired is the number of damaged data blocks that didn't match their checksums once rebuilt
+	unrepaired int
+	// damagedParity is the number of damaged parity blocks
+	damagedParity int
+	// tooDamaged is set when too few blocks are left to rebuild the rest
+	tooDamaged bool
+}
+
+// repairStripe reads stripe s of the file in data, and rebuilds its damaged data blocks
+func (h *parityHeader) repairStripe(data io.ReaderAt, parity *parityFile, s int) (*stripeRepair, error) {
+	blocks, err := h.readStripe(data, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]byte
+	var values [][]byte
+	var damaged []int
+	for i, block := range blocks {
+		// the padding at the end of the last stripe is always zeros
+		b := h.dataBlock(s, i)
+		if b < 0 || crc32.ChecksumIEEE(block) == h.checksum(b) {
+			row := make([]byte, h.Data)
+			row[i] = 1
+			rows = append(rows, row)
+			values = append(values, block)
+		} else {
+			damaged = append(damaged, i)
+		}
+	}
+
+	r := &stripeRepair{blocks: map[int][]byte{}}
+	for j := 0; j < h.Parity; j++ {
+		n := s*h.Parity + j
+		p, err := parity.block(h, n)
+		if err != nil {
+			return nil, err
+		}
+		if crc32.ChecksumIEEE(p) != h.checksum(h.dataBlocks()+n) {
+			r.damagedParity++
+			continue
+		}
+		if len(rows) < h.Data {
+			row := make([]byte, h.Data)
+			for i := range row {
+				row[i] = h.cauchy(j, i)
+			}
+			rows = append(rows, row)
+			values = append(values, p)
+		}
+	}
+
+	if len(damaged) == 0 {
+		return r, nil
+	}
+	if len(rows) < h.Data {
+		r.tooDamaged = true
+		return r, nil
+	}
+
+	inv, ok := gfMatrix(rows).invert()
+	if !ok {
+		return nil, errParityMismatch
+	}
+
+	for _, i := range damaged {
+		block := make([]byte, h.Block)
+		for k, v := range values {
+			gfMulAdd(block, v, inv[i][k])
+		}
+
+		// a damaged checksum can make a good block look damaged, so one that can't be rebuilt is left alone
+		b := h.dataBlock(s, i)
+		if crc32.ChecksumIEEE(block) != h.checksum(b) {
+			r.unrepaired++
+			continue
+		}
+		r.blocks[b] = block
+	}
+	return r, nil
+}
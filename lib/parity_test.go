@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := make([]byte, 200000)
+	rand.Read(original)
+	err = ioutil.WriteFile("data.txt", original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Encrypt("test.key", "data.txt", EncryptOptions{Parity: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	ciphertext, err := ioutil.ReadFile("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a byte, wipe out a run of blocks, and chop off the end
+	damaged := append([]byte{}, ciphertext...)
+	damaged[10] ^= 1
+	copy(damaged[50000:], make([]byte, 5*parityBlock))
+	damaged = damaged[:len(damaged)-100]
+	err = ioutil.WriteFile("data.txt.shush", damaged, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and damage the parity too
+	parity, err := ioutil.ReadFile("data.txt.shush.parity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last parity block is just before the copy of the header, and its length
+	block := len(parity) - 4 - (bytes.IndexByte(parity, '\n') + 1) - 10
+	parity[block] ^= 1
+	err = ioutil.WriteFile("data.txt.shush.parity", parity, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err == nil {
+		t.Fatal("decrypted a damaged file")
+	}
+
+	err = Repair("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err := ioutil.ReadFile("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(repaired, ciphertext) {
+		t.Fatal("repaired file doesn't match the original")
+	}
+
+	err = Decrypt("test.key", "data.txt.shush", DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the parity file should have been rebuilt too
+	err = Repair("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := ioutil.ReadFile("data.txt.shush.parity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parity[block] ^= 1
+	if !bytes.Equal(rebuilt, parity) {
+		t.Fatal("parity file wasn't rebuilt")
+	}
+
+	// more damage to one stripe than its parity can cover still leaves the other stripes repaired
+	h, p, err := readParity("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	damaged = append([]byte{}, ciphertext...)
+	for i := 0; i <= h.Parity; i++ {
+		damaged[h.dataBlock(0, i)*h.Block] ^= 1
+	}
+	fixable := h.dataBlock(1, 0) * h.Block
+	damaged[fixable] ^= 1
+	err = ioutil.WriteFile("data.txt.shush", damaged, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Repair("data.txt.shush")
+	if err == nil || err.Error() != errTooDamaged([]int{0}).Error() {
+		t.Fatal("expected the first stripe to be too damaged, got", err)
+	}
+	repaired, err = ioutil.ReadFile("data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired[fixable] != ciphertext[fixable] || repaired[0] == ciphertext[0] {
+		t.Fatal("expected only the stripes that could be repaired to be")
+	}
+	rebuilt, err = ioutil.ReadFile("data.txt.shush.parity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt, parity) {
+		t.Fatal("the parity file was rebuilt from damaged data")
+	}
+}
+
+func TestRepairHeader(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	original := make([]byte, 200000)
+	rand.Read(original)
+	err := ioutil.WriteFile("data.txt", original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeParity("data.txt", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parity, err := ioutil.ReadFile("data.txt.parity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove("data.txt.parity") })
+
+	// a damaged header, or its copy at the end, is found and rewritten
+	header := bytes.IndexByte(parity, '\n')
+	for _, offset := range []int{header / 2, header, len(parity) - header/2} {
+		damaged := append([]byte{}, parity...)
+		damaged[offset] ^= 1
+		err = ioutil.WriteFile("data.txt.parity", damaged, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Repair("data.txt")
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		rebuilt, err := ioutil.ReadFile("data.txt.parity")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rebuilt, parity) {
+			t.Fatalf("offset %d: the parity file wasn't rebuilt", offset)
+		}
+	}
+
+	// the data can still be repaired with only the copy of the header
+	damaged := append([]byte{}, parity...)
+	damaged[header/2] ^= 1
+	err = ioutil.WriteFile("data.txt.parity", damaged, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{}, original...)
+	data[5000] ^= 1
+	err = ioutil.WriteFile("data.txt", data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Repair("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repaired, err := ioutil.ReadFile("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(repaired, original) {
+		t.Fatal("repaired file doesn't match the original")
+	}
+
+	// a wrong checksum in a header we can't check leaves the block alone, and the rest is still repaired
+	h, p, err := readParity("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	data = append([]byte{}, original...)
+	data[0] ^= 1
+	h.Checksums[4] ^= 1
+	repairedBlocks, unrepaired := 0, 0
+	for s := 0; s < h.stripes(); s++ {
+		r, err := h.repairStripe(bytes.NewReader(data), p, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for b, block := range r.blocks {
+			copy(data[b*h.Block:], block)
+			repairedBlocks++
+		}
+		unrepaired += r.unrepaired
+	}
+	if repairedBlocks != 1 || unrepaired != 1 || !bytes.Equal(data, original) {
+		t.Fatalf("repaired %d and left %d blocks", repairedBlocks, unrepaired)
+	}
+}
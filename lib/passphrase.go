@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+var (
+	errEmptyPassphrase    = errors.New("the passphrase can't be empty")
+	errPassphraseMismatch = errors.New("the passphrases didn't match")
+)
+
+// readPassphrase asks for a passphrase after printing prompt. At a terminal the passphrase isn't echoed, and
+// otherwise it's read a line at a time from stdin, so it can be scripted. Tests replace it.
+var readPassphrase = func(prompt string) ([]byte, error) {
+	// the prompt goes to the terminal, or stderr without one, so it never ends up in output redirected from stdout
+	out := io.Writer(os.Stderr)
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		out = tty
+	}
+	fmt.Fprint(out, prompt)
+	defer fmt.Fprint(out, "\n")
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		return term.ReadPassword(fd)
+	}
+	return readLine(os.Stdin)
+}
+
+// readLine reads up to the end of a line from r, a byte at a time, so nothing after it is read
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// newPassphrase asks for a new passphrase twice, to catch typos
+func newPassphrase(prompt string) ([]byte, error) {
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errEmptyPassphrase
+	}
+
+	again, err := readPassphrase("Again, to confirm: ")
+	if err != nil {
+		wipe(passphrase)
+		return nil, err
+	}
+	defer wipe(again)
+	if !bytes.Equal(passphrase, again) {
+		wipe(passphrase)
+		return nil, errPassphraseMismatch
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,335 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var (
+	errPolicyNotSatisfied = errors.New("the shards provided don't satisfy the policy")
+	errPolicyExtend       = errors.New("shards split with a policy can't be extended; reshare with a new policy instead")
+	errInvalidPolicy      = func(reason string) error { return fmt.Errorf("invalid policy: %s", reason) }
+)
+
+// Policy is an access structure. The secret, or a group's share of it, can be recovered once Threshold of its
+// Groups and Members have been recovered. Groups can be nested as deeply as needed.
+type Policy struct {
+	Name      string    `json:"name,omitempty"`
+	Threshold int       `json:"threshold"`
+	Groups    []*Policy `json:"groups,omitempty"`
+	Members   []string  `json:"members,omitempty"`
+}
+
+// LoadPolicy reads a policy from a file, written either in the policy language or as json, like:
+//
+//	{"threshold": 2, "groups": [
+//	  {"name": "legal", "threshold": 2, "members": ["alice", "bob", "carol", "dave"]},
+//	  {"name": "execs", "threshold": 3, "members": ["erin", "frank", "grace", "heidi", "ivan"]}
+//	]}
+func LoadPolicy(path string) (*Policy, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(contents), []byte("{")) {
+		return ParsePolicy(string(contents))
+	}
+
+	p := &Policy{}
+	d := json.NewDecoder(bytes.NewReader(contents))
+	d.DisallowUnknownFields()
+	if err := d.Decode(p); err != nil {
+		return nil, errInvalidPolicy(err.Error())
+	}
+
+	return p, p.validate()
+}
+
+// validate checks every node in the policy
+func (p *Policy) validate() error {
+	children := len(p.Groups) + len(p.Members)
+	if children == 0 {
+		return errInvalidPolicy(fmt.Sprintf("%s has no groups or members", p.label()))
+	}
+	if children > fieldGF256.maxShards() {
+		return errInvalidPolicy(fmt.Sprintf("%s has more than %d groups and members", p.label(), fieldGF256.maxShards()))
+	}
+	if p.Threshold < 1 || p.Threshold > children {
+		return errInvalidPolicy(fmt.Sprintf("%s needs a threshold between 1 and %d", p.label(), children))
+	}
+
+	// a member listed twice would get both shares, and count twice towards the threshold
+	seen := map[string]bool{}
+	for _, m := range p.Members {
+		if !validHolderName.MatchString(m) {
+			return errInvalidPolicy(fmt.Sprintf("invalid member name \"%s\"", m))
+		}
+		if seen[m] {
+			return errInvalidPolicy(fmt.Sprintf("%s lists \"%s\" more than once", p.label(), m))
+		}
+		seen[m] = true
+	}
+
+	for _, g := range p.Groups {
+		if err := g.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// label names the node when explaining the policy
+func (p *Policy) label() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return "policy"
+}
+
+// holders returns every member of the policy, in the order they first appear
+func (p *Policy) holders() (holders []string) {
+	seen := map[string]bool{}
+	var walk func(*Policy)
+	walk = func(n *Policy) {
+		for _, g := range n.Groups {
+			walk(g)
+		}
+		for _, m := range n.Members {
+			if !seen[m] {
+				seen[m] = true
+				holders = append(holders, m)
+			}
+		}
+	}
+	walk(p)
+	return holders
+}
+
+// policyShare is the share given to a single member of the policy. Path holds the index of the node at each level,
+// where each node's groups come before its members.
+type policyShare struct {
+	path  []int
+	value []byte
+}
+
+// pathKey returns a map key for a path
+func pathKey(path []int) string {
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = strconv.Itoa(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// child returns a copy of path, extended with i
+func child(path []int, i int) []int {
+	return append(append([]int{}, path...), i)
+}
+
+// share splits secret between the groups and members of the policy, and returns the shares for each member.
+// Groups that need all of their members use xor sharing, groups that need any one of them get a copy of the secret,
+// and everything in between uses shamir.
+func (p *Policy) share(secret []byte, path []int, out map[string][]policyShare) error {
+	children := len(p.Groups) + len(p.Members)
+
+	var shares [][]byte
+	var err error
+	switch {
+	case p.Threshold == 1:
+		shares = make([][]byte, children)
+		for i := range shares {
+			shares[i] = secret
+		}
+	case p.Threshold == children:
+		shares, err = xorSplit(secret, children)
+	default:
+		xs := make([]uint32, children)
+		for i := range xs {
+			xs[i] = uint32(i + 1)
+		}
+		shares, err = splitField(fieldGF256, secret, xs, p.Threshold)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, g := range p.Groups {
+		if err := g.share(shares[i], child(path, i), out); err != nil {
+			return err
+		}
+	}
+	for i, m := range p.Members {
+		j := len(p.Groups) + i
+		out[m] = append(out[m], policyShare{path: child(path, j), value: shares[j]})
+	}
+
+	return nil
+}
+
+// xorSplit returns n random shares, which xor together to make secret
+func xorSplit(secret []byte, n int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	last := append([]byte{}, secret...)
+	for i := 0; i < n-1; i++ {
+		shares[i] = make([]byte, len(secret))
+		if _, err := rand.Read(shares[i]); err != nil {
+			return nil, err
+		}
+		for k, b := range shares[i] {
+			last[k] ^= b
+		}
+	}
+	shares[n-1] = last
+	return shares, nil
+}
+
+// recover rebuilds the secret from the member shares we have, keyed by their path, and returns the paths of the
+// shares it used. It appends a line to report for every node, and returns nil if the node can't be recovered.
+func (p *Policy) recover(shares map[string][]byte, path []int, depth int, report *[]string) ([]byte, []string) {
+	line := len(*report)
+	*report = append(*report, "")
+
+	indent := strings.Repeat("  ", depth+1)
+	var values [][]byte
+	var xs []uint32
+	var used [][]string
+	var missing []string
+	for i, g := range p.Groups {
+		if v, u := g.recover(shares, child(path, i), depth+1, report); v != nil {
+			values = append(values, v)
+			xs = append(xs, uint32(i+1))
+			used = append(used, u)
+		}
+	}
+	for i, m := range p.Members {
+		j := len(p.Groups) + i
+		key := pathKey(child(path, j))
+		if v, ok := shares[key]; ok {
+			values = append(values, v)
+			xs = append(xs, uint32(j+1))
+			used = append(used, []string{key})
+			*report = append(*report, fmt.Sprintf("%s  [x] %s", indent, m))
+		} else {
+			missing = append(missing, m)
+			*report = append(*report, fmt.Sprintf("%s  [ ] %s", indent, m))
+		}
+	}
+
+	children := len(p.Groups) + len(p.Members)
+	if len(values) < p.Threshold {
+		(*report)[line] = fmt.Sprintf("%s[ ] %s: %d of %d needed, have %d", indent, p.label(), p.Threshold, children,
+			len(values))
+		if len(missing) > 0 {
+			(*report)[line] += fmt.Sprintf(" (missing %s)", strings.Join(missing, ", "))
+		}
+		return nil, nil
+	}
+	(*report)[line] = fmt.Sprintf("%s[x] %s: %d of %d needed", indent, p.label(), p.Threshold, children)
+
+	// only the first threshold of values are combined, so the shares behind the rest go unchecked
+	var paths []string
+	for _, u := range used[:p.Threshold] {
+		paths = append(paths, u...)
+	}
+
+	switch {
+	case p.Threshold == 1:
+		return values[0], paths
+	case p.Threshold == children:
+		secret := make([]byte, len(values[0]))
+		for _, v := range values {
+			for k, b := range v {
+				secret[k] ^= b
+			}
+		}
+		return secret, paths
+	default:
+		return combineField(fieldGF256, xs[:p.Threshold], values[:p.Threshold]), paths
+	}
+}
+
+// policyShares returns the paths of the shares that recovering the policy would use, or nil if the shards don't
+// satisfy it. Which shares are used only depends on which shares we have.
+func policyShares(shards []*shard) map[string]bool {
+	header := shards[0].header
+	have := map[string][]byte{}
+	for _, s := range shards {
+		if s.header == nil || s.header.Set != header.Set {
+			return nil
+		}
+		for _, path := range s.header.Paths {
+			have[pathKey(path)] = []byte{}
+		}
+	}
+
+	var report []string
+	secret, paths := header.Policy.recover(have, nil, 0, &report)
+	if secret == nil {
+		return nil
+	}
+	used := map[string]bool{}
+	for _, path := range paths {
+		used[path] = true
+	}
+	return used
+}
+
+// combinePolicy returns a reader of the digest key and secret in shards that were split with a policy, after explaining which parts
+// of the policy are satisfied
+func combinePolicy(shards []*shard) (io.Reader, error) {
+	header := shards[0].header
+	var paths []string
+	for _, s := range shards {
+		if s.header == nil || s.header.Set != header.Set {
+			return nil, errMixedSets
+		}
+		for _, path := range s.header.Paths {
+			paths = append(paths, pathKey(path))
+		}
+	}
+
+	// which parts are satisfied only depends on which shares we have
+	have := map[string][]byte{}
+	for _, path := range paths {
+		have[path] = []byte{}
+	}
+	var report []string
+	satisfied, _ := header.Policy.recover(have, nil, 0, &report)
+
+	fmt.Println("Checking policy:")
+	for _, line := range report {
+		fmt.Println(line)
+	}
+	fmt.Print("\n")
+
+	if satisfied == nil {
+		return nil, errPolicyNotSatisfied
+	}
+
+	block := blockSymbols(fieldGF256, len(paths))
+	var values [][]byte
+	r := &pieceReader{secret: true, next: func() ([]byte, error) {
+		wipeAll(values)
+		var err error
+		values, err = readShares(shards, block)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, path := range paths {
+			have[path] = values[i]
+		}
+		report = report[:0]
+		secret, _ := header.Policy.recover(have, nil, 0, &report)
+		return secret, nil
+	}}
+	return &lengthReader{r: r, left: digestPrefix(header) + int64(header.Length)}, nil
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy("(alice AND bob) or (2 OF carol, dave, (erin and frank))")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy.Threshold != 1 || len(policy.Groups) != 2 || len(policy.Members) != 0 {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+	if policy.Name != "(alice AND bob) OR (2 of carol, dave, (erin AND frank))" {
+		t.Fatal("unexpected name", policy.Name)
+	}
+
+	and, k := policy.Groups[0], policy.Groups[1]
+	if and.Threshold != 2 || len(and.Members) != 2 {
+		t.Fatalf("unexpected AND clause %+v", and)
+	}
+	if k.Threshold != 2 || len(k.Members) != 2 || len(k.Groups) != 1 {
+		t.Fatalf("unexpected 2 of clause %+v", k)
+	}
+
+	for _, expr := range []string{"", "alice AND", "(alice OR bob", "alice bob", "4 of a, b, c", "0 of a", "a.b",
+		"2 of alice, alice, bob", "alice AND alice AND bob"} {
+		if _, err := ParsePolicy(expr); err == nil {
+			t.Fatalf("expected %q to be invalid", expr)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+
+	err := ioutil.WriteFile("policy.json", []byte(testPolicy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPolicy("policy.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// one member can't hold two of a group's shares
+	err = ioutil.WriteFile("policy.json", []byte(`{"threshold": 2, "members": ["alice", "alice", "bob"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPolicy("policy.json"); err == nil {
+		t.Fatal("expected a member listed twice to be invalid")
+	}
+}
+
+func TestPolicyShareRecover(t *testing.T) {
+	secret := []byte("a secret for the legal team")
+	policy, err := ParsePolicy("(alice AND bob) OR (2 of carol, dave, erin)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares := map[string][]policyShare{}
+	if err := policy.share(secret, nil, shares); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		holders []string
+		ok      bool
+	}{
+		{[]string{"alice", "bob"}, true},
+		{[]string{"carol", "erin"}, true},
+		{[]string{"alice", "dave"}, false},
+		{[]string{"bob", "erin"}, false},
+	} {
+		have := map[string][]byte{}
+		for _, h := range c.holders {
+			for _, s := range shares[h] {
+				have[pathKey(s.path)] = s.value
+			}
+		}
+
+		var report []string
+		recovered, _ := policy.recover(have, nil, 0, &report)
+		if c.ok && !bytes.Equal(recovered, secret) {
+			t.Fatalf("%v: recovered %q", c.holders, recovered)
+		} else if !c.ok && recovered != nil {
+			t.Fatalf("%v: shouldn't satisfy the policy", c.holders)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The policy language describes who can recover a secret, like:
+//
+//	(alice AND bob) OR (2 of carol, dave, erin)
+//
+// AND binds tighter than OR, and "k of" takes a comma separated list of names or parenthesized clauses. Keywords
+// are case insensitive.
+
+var policyToken = regexp.MustCompile(`\s*([()]|,|[A-Za-z0-9_-]+)`)
+
+// policyParser turns a policy expression into a tree of Policy nodes
+type policyParser struct {
+	tokens []string
+	pos    int
+}
+
+// ParsePolicy compiles a policy expression into a Policy. Each clause becomes a group, named after its expression,
+// so that merge can explain which clauses are satisfied.
+func ParsePolicy(expr string) (*Policy, error) {
+	p := &policyParser{}
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		m := policyToken.FindStringSubmatchIndex(rest)
+		if m == nil || m[0] != 0 {
+			return nil, errInvalidPolicy(fmt.Sprintf("unexpected \"%s\"", rest))
+		}
+		p.tokens = append(p.tokens, rest[m[2]:m[3]])
+		rest = strings.TrimSpace(rest[m[1]:])
+	}
+
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errInvalidPolicy(fmt.Sprintf("unexpected \"%s\"", p.tokens[p.pos]))
+	}
+
+	root := n.policy()
+	return root, root.validate()
+}
+
+// policyNode is either a member, or a clause that needs threshold of its children
+type policyNode struct {
+	member    string
+	threshold int
+	children  []*policyNode
+}
+
+// peek returns the next token, or an empty string at the end of the expression
+func (p *policyParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// keyword consumes the next token if it matches word
+func (p *policyParser) keyword(word string) bool {
+	if strings.EqualFold(p.peek(), word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// or parses clauses joined by OR, which need any one of them
+func (p *policyParser) or() (*policyNode, error) {
+	return p.join("OR", p.and, func(n int) int { return 1 })
+}
+
+// and parses clauses joined by AND, which need all of them
+func (p *policyParser) and() (*policyNode, error) {
+	return p.join("AND", p.atom, func(n int) int { return n })
+}
+
+// join parses clauses separated by op, and needs threshold(n) of the n clauses
+func (p *policyParser) join(op string, next func() (*policyNode, error), threshold func(int) int) (*policyNode,
+	error) {
+	n, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*policyNode{n}
+	for p.keyword(op) {
+		n, err := next()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, n)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &policyNode{threshold: threshold(len(children)), children: children}, nil
+}
+
+// atom parses a member, a parenthesized clause, or a "k of" list
+func (p *policyParser) atom() (*policyNode, error) {
+	tok := p.peek()
+	switch {
+	case tok == "":
+		return nil, errInvalidPolicy("unexpected end of policy")
+	case tok == "(":
+		p.pos++
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, errInvalidPolicy("missing \")\"")
+		}
+		return n, nil
+	case tok == ")" || tok == "," || strings.EqualFold(tok, "AND") || strings.EqualFold(tok, "OR") ||
+		strings.EqualFold(tok, "of"):
+		return nil, errInvalidPolicy(fmt.Sprintf("unexpected \"%s\"", tok))
+	}
+
+	p.pos++
+	k, err := strconv.Atoi(tok)
+	if err != nil || !p.keyword("of") {
+		return &policyNode{member: tok}, nil
+	}
+
+	n := &policyNode{threshold: k}
+	for {
+		child, err := p.atom()
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, child)
+
+		if !p.keyword(",") {
+			return n, nil
+		}
+	}
+}
+
+// policy converts the parsed tree into a Policy
+func (n *policyNode) policy() *Policy {
+	if n.member != "" {
+		return &Policy{Threshold: 1, Members: []string{n.member}}
+	}
+
+	out := &Policy{Name: n.String(), Threshold: n.threshold}
+	for _, c := range n.children {
+		if c.member != "" {
+			out.Members = append(out.Members, c.member)
+		} else {
+			out.Groups = append(out.Groups, c.policy())
+		}
+	}
+	return out
+}
+
+// String formats the clause back into the policy language
+func (n *policyNode) String() string {
+	if n.member != "" {
+		return n.member
+	}
+
+	parts := make([]string, len(n.children))
+	for i, c := range n.children {
+		parts[i] = c.String()
+		if c.member == "" {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+
+	switch {
+	case len(n.children) > 1 && n.threshold == len(n.children):
+		return strings.Join(parts, " AND ")
+	case len(n.children) > 1 && n.threshold == 1:
+		return strings.Join(parts, " OR ")
+	default:
+		return fmt.Sprintf("%d of %s", n.threshold, strings.Join(parts, ", "))
+	}
+}
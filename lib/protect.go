@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// protectedShardVersion is the version of shards sealed with a passphrase, which older versions of shush refuse
+// rather than misread
+const protectedShardVersion = 2
+
+var errWrongShardPassphrase = func(path string) error {
+	return fmt.Errorf("wrong passphrase for %s, or its header was changed", path)
+}
+
+// shardProtection says how the passphrase that a protected shard's shares are sealed with was stretched into a key.
+// Protected shards hold a stream of their shares, sealed with AES-256-GCM in chunks, after the header.
+type shardProtection struct {
+	KDF    string    `json:"kdf"`
+	Params kdfParams `json:"params"`
+	Salt   []byte    `json:"salt"`
+}
+
+// sealedAD returns what every chunk of a protected shard's shares but the last authenticates: the header line, with
+// the placeholder digest it's first written with. The last chunk is sealed once the digest is known, and
+// authenticates the whole header line, so nothing in the header can be changed without failing to open.
+func (h *shardHeader) sealedAD() ([]byte, error) {
+	placeholder := *h
+	placeholder.Digest = make([]byte, len(h.Digest))
+	return json.Marshal(&placeholder)
+}
+
+// protectShards asks each holder in turn for a passphrase for the shard described by their header, and returns the
+// keys the shards are sealed with
+func protectShards(name string, headers []*shardHeader) ([][]byte, error) {
+	keys := make([][]byte, len(headers))
+	for i, h := range headers {
+		var err error
+		keys[i], err = protectShard(shardName(name, h), h)
+		if err != nil {
+			wipeAll(keys)
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// protectShard asks for a new passphrase for the shard at path, and records how it's stretched in its header
+func protectShard(path string, h *shardHeader) ([]byte, error) {
+	prompt := fmt.Sprintf("Passphrase for %s: ", path)
+	if h.Holder != "" {
+		prompt = fmt.Sprintf("Passphrase for %s, to be chosen by %s: ", path, h.Holder)
+	}
+	passphrase, err := newPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	defer wipe(passphrase)
+
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	h.Version = protectedShardVersion
+	h.Protection = &shardProtection{KDF: "argon2id", Params: defaultKDF, Salt: salt}
+	return h.Protection.Params.key(passphrase, salt), nil
+}
+
+// unlock asks for the passphrase of a protected shard, and opens its shares with it. Shards without a passphrase are
+// left as they are.
+func (s *shard) unlock() error {
+	if s.header == nil || s.header.Protection == nil {
+		return nil
+	}
+
+	prompt := fmt.Sprintf("Passphrase for %s: ", s.path)
+	if s.header.Holder != "" {
+		prompt = fmt.Sprintf("Passphrase for %s, held by %s: ", s.path, s.header.Holder)
+	}
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return err
+	}
+
+	p := s.header.Protection
+	key := p.Params.key(passphrase, p.Salt)
+	wipe(passphrase)
+	gcm, err := newGCM(key)
+	wipe(key)
+	if err != nil {
+		return err
+	}
+
+	ad, err := s.header.sealedAD()
+	if err != nil {
+		return err
+	}
+
+	// a wrong passphrase fails on the first chunk, which is better caught now than partway through combining. So
+	// does a changed header, which is why the error can't say which it was.
+	r := bufio.NewReader(newOpenReader(gcm, s.r, s.body, ad, s.line))
+	if _, err := r.Peek(1); err == io.ErrUnexpectedEOF {
+		return errInvalidShard(s.path)
+	} else if err != nil {
+		return errWrongShardPassphrase(s.path)
+	}
+	s.r = r
+	return nil
+}
+
+// unlockShards asks for the passphrase of each protected shard in turn
+func unlockShards(shards []*shard) error {
+	for _, s := range shards {
+		if err := s.unlock(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
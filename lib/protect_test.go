@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProtectedShards(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	// enough to take several chunks of each shard
+	secret := make([]byte, 150*1024)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile("secrets", secret, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holders, err := ParseHolders("cto:2,cfo,eng1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrases(t, "cto", "cto", "cfo", "cfo", "eng1", "eng1")
+	err = Split("secrets", 0, 3, SplitOptions{Holders: holders, Protect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing needs a passphrase to describe a shard
+	details := describes(t, "secrets.shard-cfo")
+	if details["Version"] != "2" || details["Protection"] == "" {
+		t.Fatalf("the protected shard was described as %v", details)
+	}
+
+	os.Remove("secrets")
+
+	// one wrong passphrase is enough to stop a merge
+	passphrases(t, "cto", "eng2")
+	err = Merge([]string{"secrets.shard-cto", "secrets.shard-eng1"})
+	if err == nil || err.Error() != errWrongShardPassphrase("secrets.shard-eng1").Error() {
+		t.Fatal("expected a wrong passphrase to fail, got", err)
+	}
+
+	passphrases(t, "cto", "eng1")
+	err = Merge([]string{"secrets.shard-cto", "secrets.shard-eng1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := ioutil.ReadFile("secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, secret) {
+		t.Fatal("the merged secret doesn't match")
+	}
+
+	// the header can't be changed without the shares failing to open
+	contents, err := ioutil.ReadFile("secrets.shard-eng1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.IndexByte(contents, '\n')
+	h := &shardHeader{}
+	if err := json.Unmarshal(contents[:i], h); err != nil {
+		t.Fatal(err)
+	}
+	h.Threshold = 2
+	line, _ := json.Marshal(h)
+	err = ioutil.WriteFile("tampered.shard-eng1", append(line, contents[i:]...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("secrets")
+	passphrases(t, "cto", "eng1")
+	err = Merge([]string{"secrets.shard-cto", "tampered.shard-eng1"})
+	if err == nil || err.Error() != errWrongShardPassphrase("tampered.shard-eng1").Error() {
+		t.Fatal("expected a changed header to fail, got", err)
+	}
+
+	// a shard issued for a protected set is protected too
+	passphrases(t, "cfo", "eng1", "cto", "new", "new")
+	err = Extend([]string{"secrets.shard-cfo", "secrets.shard-eng1", "secrets.shard-cto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details := describes(t, "secrets.shard4"); details["Protection"] == "" {
+		t.Fatalf("the new shard was described as %v", details)
+	}
+	passphrases(t, "new", "cto")
+	err = VerifySet([]string{"secrets.shard4", "secrets.shard-cto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// protection works with compact sets
+	deleteTestFiles()
+	err = ioutil.WriteFile("secrets", secret, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrases(t, "a", "a", "b", "b", "c", "c")
+	err = Split("secrets", 3, 2, SplitOptions{Compact: true, Protect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrases(t, "c", "a")
+	err = Reshare([]string{"secrets.shard2", "secrets.shard0"}, "new.key", 3, 2, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Merge([]string{"new.key.shard1", "new.key.shard2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err = ioutil.ReadFile("new.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, secret) {
+		t.Fatal("the reshared secret doesn't match")
+	}
+
+	// settings that would take forever, or all of our memory, are refused before asking for the passphrase
+	for _, damage := range []func(p *shardProtection){
+		func(p *shardProtection) { p.Params.Memory = 1<<32 - 1 },
+		func(p *shardProtection) { p.Params.Time = 1<<32 - 1 },
+		func(p *shardProtection) { p.Salt = nil },
+	} {
+		contents, err := ioutil.ReadFile("secrets.shard2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := bytes.IndexByte(contents, '\n')
+		h := &shardHeader{}
+		if err := json.Unmarshal(contents[:i], h); err != nil {
+			t.Fatal(err)
+		}
+		damage(h.Protection)
+		line, _ := json.Marshal(h)
+		err = ioutil.WriteFile("costly.shard", append(line, contents[i:]...), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openShard("costly.shard"); err != errInvalidKDF {
+			t.Fatal("expected invalid settings, got", err)
+		}
+	}
+}
@@ -0,0 +1,667 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	shardVersion = 1
+	// shardMemory is roughly how much memory a block of every share in a set may take up
+	shardMemory = 4 << 20
+)
+
+var (
+	errMixedSets      = errors.New("the shards provided belong to different sets")
+	errDuplicateShard = errors.New("the same shard was provided more than once")
+	errMissingSetInfo = errors.New("shard has no set information; reshare the set to upgrade it")
+	errTooManyShards  = func(f field) error {
+		return fmt.Errorf("the %s field supports at most %d shards", f.name(), f.maxShards())
+	}
+	errInvalidShard     = func(path string) error { return fmt.Errorf("\"%s\" is not a valid shard", path) }
+	errBelowThreshold   = func(threshold int) error { return fmt.Errorf("this set needs at least %d shards", threshold) }
+	errUnsupportedShard = func(version int) error {
+		return fmt.Errorf("shard version %d is not supported by this version of shush", version)
+	}
+)
+
+// shardHeader is the metadata written on the first line of a shard file
+type shardHeader struct {
+	Version int `json:"version"`
+	// Set is a random ID shared by every shard in the set
+	Set       string `json:"set"`
+	Index     int    `json:"index"`
+	Holder    string `json:"holder,omitempty"`
+	Threshold int    `json:"threshold"`
+	// Weight is the number of shares in the shard file
+	Weight int `json:"weight,omitempty"`
+	// Field is the name of the field the secret was shared over
+	Field string `json:"field"`
+	// Length of the secret, which may have been padded to a whole number of field elements
+	Length int `json:"length"`
+	// Dispersed is the length of the ciphertext spread over the shards of a compact set
+	Dispersed int `json:"dispersed,omitempty"`
+	// Issued lists every x-coordinate handed out for this set, as far as this shard knows
+	Issued []int `json:"issued,omitempty"`
+	// Policy is the access structure of sets split with a policy, and Paths says where each share sits in it
+	Policy *Policy `json:"policy,omitempty"`
+	Paths  [][]int `json:"paths,omitempty"`
+	// Xs holds the x-coordinate of each share in the file
+	Xs []int `json:"xs,omitempty"`
+	// Block is the number of elements of each share in a block of the file
+	Block int `json:"block,omitempty"`
+	// Chunk is the size of the chunks the ciphertext of a compact set was sealed in
+	Chunk int `json:"chunk,omitempty"`
+	// Created is when the shard was written
+	Created *time.Time `json:"created,omitempty"`
+	// Digest is an HMAC of the secret, keyed with a key that's shared ahead of the secret
+	Digest []byte `json:"digest,omitempty"`
+	// KeyID is the ID of the key that was split, if the secret is a key file
+	KeyID string `json:"keyid,omitempty"`
+	// Protection is how the shard's passphrase is stretched, if it has one
+	Protection *shardProtection `json:"protection,omitempty"`
+}
+
+// Shard files are a json header line, followed by the shares in binary. Each share is cut into blocks of Block
+// elements, and the file holds the first block of every share, then the second block of every share, and so on, so
+// that the shares can be written and read a block at a time. The oldest shards have no header, and hold a single share
+// in base64, with its x-coordinate at the end.
+
+// shard is an open shard file, holding one or more shares of a secret
+type shard struct {
+	path   string
+	header *shardHeader // nil for shards written before shush tracked sets
+	field  field
+	// xs holds the x-coordinate of each share, which policy shares don't have
+	xs     []uint32
+	weight int
+	// length of the secret
+	length  int
+	block   int
+	r       io.Reader
+	closer  io.Closer
+	pending [][]byte
+	// buf holds the block being read, and is reused for each block
+	buf *secureBuffer
+	// body is the length of the shares in a protected shard, once they're opened
+	body int64
+	// line is the header line, which the sealed shares of a protected shard authenticate
+	line []byte
+}
+
+// newSet returns the header of each of the shard files in a new set, with a share at each x. Without holders, every
+// share gets a file of its own.
+func newSet(f field, xs []uint32, holders []Holder, threshold int, length int) ([]*shardHeader, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	issued := make([]int, len(xs))
+	for i, x := range xs {
+		issued[i] = int(x)
+	}
+
+	if len(holders) == 0 {
+		holders = make([]Holder, len(xs))
+		for i := range holders {
+			holders[i].Weight = 1
+		}
+	}
+
+	block := blockSymbols(f, len(xs))
+	headers := make([]*shardHeader, len(holders))
+	offset := 0
+	for i, h := range holders {
+		headers[i] = &shardHeader{
+			Version:   shardVersion,
+			Set:       hex.EncodeToString(id),
+			Index:     i,
+			Holder:    h.Name,
+			Threshold: threshold,
+			Weight:    h.Weight,
+			Field:     f.name(),
+			Length:    length,
+			Issued:    issued,
+			Xs:        issued[offset : offset+h.Weight],
+			Block:     block,
+			Created:   created(),
+		}
+		offset += h.Weight
+	}
+	return headers, nil
+}
+
+// newPolicySet returns the header of the shard file of each member of the policy
+func newPolicySet(policy *Policy, length int) ([]*shardHeader, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	// where each member's shares sit doesn't depend on the secret
+	shares := map[string][]policyShare{}
+	if err := policy.share(nil, nil, shares); err != nil {
+		return nil, err
+	}
+
+	holders := policy.holders()
+	block := blockSymbols(fieldGF256, len(holders))
+	headers := make([]*shardHeader, len(holders))
+	for i, h := range holders {
+		headers[i] = &shardHeader{
+			Version:   shardVersion,
+			Set:       hex.EncodeToString(id),
+			Index:     i,
+			Holder:    h,
+			Threshold: policy.Threshold,
+			Weight:    len(shares[h]),
+			Field:     fieldGF256.name(),
+			Length:    length,
+			Policy:    policy,
+			Block:     block,
+			Created:   created(),
+		}
+		for _, share := range shares[h] {
+			headers[i].Paths = append(headers[i].Paths, share.path)
+		}
+	}
+	return headers, nil
+}
+
+// created returns the current time, to record when a file was written
+func created() *time.Time {
+	now := time.Now().UTC().Truncate(time.Second)
+	return &now
+}
+
+// blockSymbols picks how many elements of each share go in a block, so that a block of every share fits in about
+// shardMemory
+func blockSymbols(f field, shares int) int {
+	block := shardMemory / (shares * f.size())
+	if block < 64 {
+		return 64
+	}
+	if block > 1<<16 {
+		return 1 << 16
+	}
+	return block
+}
+
+// shardName returns the file name of a shard in the set of the original file
+func shardName(originalFileName string, header *shardHeader) string {
+	if header.Holder != "" {
+		return fmt.Sprintf("%s%s-%s", originalFileName, shardExt, header.Holder)
+	}
+	return fmt.Sprintf("%s%s%d", originalFileName, shardExt, header.Index)
+}
+
+// shardWriter writes the shares of a shard file as they're computed
+type shardWriter struct {
+	path    string
+	file    *newFile
+	header  *shardHeader
+	line    int
+	size    int
+	pending [][]byte
+	// out is where the shares are written, which seals them first for protected shards
+	out    io.Writer
+	sealer *sealWriter
+}
+
+// createShard creates a new shard file, and writes its header. If key isn't nil, the shares are sealed with it.
+func createShard(path string, header *shardHeader, key []byte) (*shardWriter, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := safeCreate(path, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &shardWriter{path: path, file: file, header: header, line: len(h),
+		pending: make([][]byte, len(header.Xs)+len(header.Paths))}
+	f, err := fieldByName(header.Field)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	w.size = header.Block * f.size()
+
+	if _, err := file.Write(append(h, '\n')); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	w.out = file.File
+	if key != nil {
+		var ad []byte
+		gcm, err := newGCM(key)
+		if err == nil {
+			ad, err = header.sealedAD()
+		}
+		if err == nil {
+			w.sealer, err = newSealWriter(gcm, file, ad)
+		}
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+		w.out = w.sealer
+	}
+	return w, nil
+}
+
+// write appends the next part of each of the shard's shares, which must all be the same length, and writes out any
+// whole blocks
+func (w *shardWriter) write(shares [][]byte) error {
+	for i, s := range shares {
+		w.pending[i] = append(w.pending[i], s...)
+	}
+
+	for len(w.pending[0]) >= w.size {
+		if err := w.flush(w.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the first n bytes of each share as a block
+func (w *shardWriter) flush(n int) error {
+	block := make([]byte, 0, n*len(w.pending))
+	for i, p := range w.pending {
+		block = append(block, p[:n]...)
+		w.pending[i] = p[n:]
+	}
+
+	_, err := w.out.Write(block)
+	wipe(block)
+	return err
+}
+
+// close writes out the last block, which may be short, and puts the file in place. The digest of the secret is only
+// known once all of it has been read, so the header is written again, over a placeholder digest of the same length,
+// and the last chunk of a protected shard's shares is the one that authenticates it.
+func (w *shardWriter) close() error {
+	var err error
+	if len(w.pending[0]) > 0 {
+		err = w.flush(len(w.pending[0]))
+	}
+
+	var h []byte
+	if err == nil {
+		h, err = json.Marshal(w.header)
+	}
+	if err == nil && len(h) != w.line {
+		err = errInvalidShard(w.path)
+	}
+	if err == nil && w.sealer != nil {
+		err = w.sealer.close(h)
+	}
+	if err == nil {
+		_, err = w.file.WriteAt(h, 0)
+	}
+	if err != nil {
+		w.file.abort()
+		return err
+	}
+	return w.file.commit()
+}
+
+// abort throws away a shard file that couldn't be finished, or removes one whose set couldn't be
+func (w *shardWriter) abort() {
+	if w.file.done {
+		os.Remove(w.path)
+		return
+	}
+	w.file.abort()
+}
+
+// openShard opens a shard file, with or without a header
+func openShard(path string) (*shard, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := readShardHeader(path, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// readShardHeader reads the header of the shard file in r. Shards from before we wrote headers are read into memory.
+func readShardHeader(path string, file *os.File) (*shard, error) {
+	r := bufio.NewReader(file)
+	s := &shard{path: path, field: fieldGF256, weight: 1}
+
+	// base64 never starts with a brace, so anything else is a shard from before we wrote headers
+	if b, err := r.Peek(1); err != nil || b[0] != '{' {
+		return s.readLegacy(r)
+	}
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, errInvalidShard(path)
+	}
+
+	s.header = &shardHeader{}
+	if err := json.Unmarshal(line, s.header); err != nil {
+		return nil, errInvalidShard(path)
+	}
+	s.line = bytes.TrimSuffix(line, []byte("\n"))
+	switch s.header.Version {
+	case shardVersion:
+		if s.header.Protection != nil {
+			return nil, errInvalidShard(path)
+		}
+	case protectedShardVersion:
+		if s.header.Protection == nil || s.header.Protection.KDF != "argon2id" {
+			return nil, errInvalidShard(path)
+		}
+		if len(s.header.Protection.Salt) == 0 || !s.header.Protection.Params.valid() {
+			return nil, errInvalidKDF
+		}
+		if s.body, err = protectedBody(file, len(line)); err != nil || s.body < 0 {
+			return nil, errInvalidShard(path)
+		}
+	default:
+		return nil, errUnsupportedShard(s.header.Version)
+	}
+	s.field, err = fieldByName(s.header.Field)
+	if err != nil {
+		return nil, err
+	}
+	if s.header.Weight > 1 {
+		s.weight = s.header.Weight
+	}
+	s.length = s.header.Length
+
+	// the threshold picks how many shares are combined, so it has to be one that could have been split
+	if s.header.Threshold < 1 || s.header.Threshold > s.field.maxShards() {
+		return nil, errInvalidShard(path)
+	}
+	if s.header.Policy != nil && s.header.Policy.validate() != nil {
+		return nil, errInvalidShard(path)
+	}
+
+	if s.header.Policy != nil {
+		if len(s.header.Paths) != s.weight {
+			return nil, errInvalidShard(path)
+		}
+	} else {
+		if len(s.header.Xs) != s.weight {
+			return nil, errInvalidShard(path)
+		}
+		for _, x := range s.header.Xs {
+			if x < 1 || x > s.field.maxShards() {
+				return nil, errInvalidShard(path)
+			}
+			s.xs = append(s.xs, uint32(x))
+		}
+	}
+	if s.header.Block < 1 {
+		return nil, errInvalidShard(path)
+	}
+
+	s.block = s.header.Block
+	s.r = r
+	s.closer = file
+	return s, nil
+}
+
+// protectedBody returns the length of the shares sealed in a protected shard file, after a header of length n, or -1
+// if nothing seals to the length of the file
+func protectedBody(file *os.File, n int) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	gcm, err := newGCM(make([]byte, keySize))
+	if err != nil {
+		return 0, err
+	}
+	return openedLength(gcm, info.Size()-int64(n)), nil
+}
+
+// readLegacy reads a shard from before we wrote headers, which holds one share in base64, ending with its
+// x-coordinate. The share is held in memory, as one block.
+func (s *shard) readLegacy(r io.Reader) (*shard, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f := s.field
+	share := base64decode(bytes.TrimSpace(contents))
+	wipe(contents)
+	size := len(share)
+	if size < 2*f.size() || size%f.size() != 0 {
+		return nil, errInvalidShard(s.path)
+	}
+
+	s.length = size - f.size()
+	s.xs = []uint32{getSymbol(f, share, size/f.size()-1)}
+	s.block = s.length / f.size()
+	s.r = bytes.NewReader(share[:s.length])
+	return s, nil
+}
+
+// read returns the next n bytes of each of the shard's shares, or fewer at the end of the file
+func (s *shard) read(n int) ([][]byte, error) {
+	out := make([][]byte, s.weight)
+	for got := 0; got < n; {
+		if len(s.pending) == 0 || len(s.pending[0]) == 0 {
+			if err := s.fill(); err == io.EOF && got > 0 {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		k := n - got
+		if k > len(s.pending[0]) {
+			k = len(s.pending[0])
+		}
+		for i, p := range s.pending {
+			out[i] = append(out[i], p[:k]...)
+			s.pending[i] = p[k:]
+		}
+		got += k
+	}
+	return out, nil
+}
+
+// fill reads the next block of the file, which is short at the end
+func (s *shard) fill() error {
+	size := s.block * s.field.size()
+	if s.buf == nil {
+		s.buf = newSecureBuffer(size * s.weight)
+	}
+	block := s.buf.bytes()
+	n, err := io.ReadFull(s.r, block)
+	if err == io.EOF {
+		return io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		if n%(s.weight*s.field.size()) != 0 {
+			return errInvalidShard(s.path)
+		}
+		size = n / s.weight
+	} else if err != nil {
+		return err
+	}
+
+	s.pending = make([][]byte, s.weight)
+	for i := range s.pending {
+		s.pending[i] = block[i*size : (i+1)*size]
+	}
+	return nil
+}
+
+// close closes the shard file, if it's still open, and wipes the block it was reading
+func (s *shard) close() {
+	if s.closer != nil {
+		s.closer.Close()
+	}
+	s.buf.release()
+}
+
+// openShards opens every shard in files, and then asks for the passphrase of each protected shard
+func openShards(files []string) ([]*shard, error) {
+	shards := make([]*shard, len(files))
+	for i, f := range files {
+		s, err := openShard(f)
+		if err != nil {
+			closeShards(shards[:i])
+			return nil, err
+		}
+		shards[i] = s
+	}
+
+	if err := unlockShards(shards); err != nil {
+		closeShards(shards)
+		return nil, err
+	}
+	return shards, nil
+}
+
+// closeShards closes every shard
+func closeShards(shards []*shard) {
+	for _, s := range shards {
+		s.close()
+	}
+}
+
+// readShares returns the next n bytes of every share held by the shards. It returns io.EOF once they have all been
+// read, and an error if any shard ends before the others.
+func readShares(shards []*shard, n int) ([][]byte, error) {
+	var shares [][]byte
+	var short *shard
+	for _, s := range shards {
+		next, err := s.read(n)
+		if err == io.EOF {
+			short = s
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(shares) > 0 && len(next[0]) != len(shares[0]) {
+			if len(next[0]) < len(shares[0]) {
+				short = s
+			}
+			return nil, errInvalidShard(short.path)
+		}
+		shares = append(shares, next...)
+		if short == nil && len(next[0]) < n {
+			short = s
+		}
+	}
+
+	if len(shares) == 0 {
+		return nil, io.EOF
+	}
+	if len(shares) != countShares(shards) {
+		return nil, errInvalidShard(short.path)
+	}
+	return shares, nil
+}
+
+// countShares returns the number of shares held by the shards
+func countShares(shards []*shard) (n int) {
+	for _, s := range shards {
+		n += s.weight
+	}
+	return n
+}
+
+// shareXs returns the x-coordinate of every share held by the shards
+func shareXs(shards []*shard) (xs []uint32) {
+	for _, s := range shards {
+		xs = append(xs, s.xs...)
+	}
+	return xs
+}
+
+// checkSet makes sure that the shards can be combined, as far as their headers can tell
+func checkSet(shards []*shard) error {
+	f := shards[0].field
+	seen := map[uint32]bool{}
+	var first *shardHeader
+	for _, s := range shards {
+		if s.field != f {
+			return errMixedSets
+		}
+
+		for _, x := range s.xs {
+			if seen[x] {
+				return errDuplicateShard
+			}
+			seen[x] = true
+		}
+
+		if s.header == nil {
+			continue
+		}
+		if first == nil {
+			first = s.header
+		} else if s.header.Set != first.Set || s.header.Length != first.Length || s.header.Chunk != first.Chunk ||
+			s.header.Dispersed != first.Dispersed || !bytes.Equal(s.header.Digest, first.Digest) {
+			return errMixedSets
+		}
+	}
+
+	// weighted shards count once for every share they hold
+	if first != nil && len(seen) < first.Threshold {
+		return errBelowThreshold(first.Threshold)
+	}
+
+	return nil
+}
+
+// siblingShards returns the shards from set that sit next to name on disk. Their headers are all we need, so they're
+// closed, and anything that isn't a shard from the set is skipped.
+func siblingShards(name string, set string) []*shard {
+	paths, _ := filepath.Glob(name + shardExt + "*")
+	var siblings []*shard
+	for _, path := range paths {
+		s, err := openShard(path)
+		if err != nil {
+			continue
+		}
+		s.close()
+		if s.header != nil && s.header.Set == set {
+			siblings = append(siblings, s)
+		}
+	}
+	return siblings
+}
+
+// issuedIndexes returns every x-coordinate known to have been issued for the set
+func issuedIndexes(shards []*shard) map[uint32]bool {
+	issued := map[uint32]bool{}
+	for _, s := range shards {
+		for _, x := range s.xs {
+			issued[x] = true
+		}
+		for _, x := range s.header.Issued {
+			issued[uint32(x)] = true
+		}
+	}
+	return issued
+}
@@ -0,0 +1,472 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+)
+
+const (
+	// streamChunk is how much plaintext is sealed at a time
+	streamChunk = 64 * 1024
+	// streamCounter is the length of the part of each chunk's nonce that isn't random
+	streamCounter = 5
+	tagSize       = 16
+)
+
+var (
+	errStreamTooLong = errors.New("too much data to encrypt in one stream")
+	errTruncated     = errors.New("the data ended before its recorded length")
+	errTrailingData  = errors.New("unexpected data after the end of the stream")
+)
+
+// authError is a chunk that failed to open, because it was damaged or sealed with a different key. It reads just like
+// the cipher's own error, but can be told apart from failures to read or write the stream.
+type authError struct {
+	err error
+}
+
+func (e authError) Error() string {
+	return e.err.Error()
+}
+
+// Streams are sealed in chunks, so that neither end needs to hold all of the data. A stream starts with a random
+// nonce prefix, followed by each sealed chunk in turn. A chunk's nonce is the prefix, the chunk's number, and a flag
+// that is only set on the last chunk, so that chunks can't be reordered, dropped, or cut off at the end. The prefix
+// fills the rest of the cipher's nonce, which is 7 bytes for AES-GCM and 19 for XChaCha20-Poly1305.
+
+// prefixSize is the length of the random nonce prefix of a stream sealed with aead
+func prefixSize(aead cipher.AEAD) int {
+	return aead.NonceSize() - streamCounter
+}
+
+// streamNonce returns the nonce of chunk i
+func streamNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, len(prefix)+streamCounter)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], i)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// streamChunks is the number of chunks that length bytes of plaintext are sealed in. Even an empty stream has one.
+func streamChunks(length int64) int64 {
+	if length == 0 {
+		return 1
+	}
+	return (length + streamChunk - 1) / streamChunk
+}
+
+// sealedLength is the length of the stream that aead seals length bytes of plaintext into
+func sealedLength(aead cipher.AEAD, length int64) int64 {
+	return int64(prefixSize(aead)) + length + streamChunks(length)*tagSize
+}
+
+// openedLength reverses sealedLength, returning -1 if no plaintext seals to that length. Every chunk but the last is
+// full, so the length of the plaintext follows from the length of the stream.
+func openedLength(aead cipher.AEAD, sealed int64) int64 {
+	sealed -= int64(prefixSize(aead))
+	chunks := (sealed + streamChunk + tagSize - 1) / (streamChunk + tagSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	length := sealed - chunks*tagSize
+	if length < 0 || sealedLength(aead, length) != sealed+int64(prefixSize(aead)) {
+		return -1
+	}
+	return length
+}
+
+// sealChunk seals chunk i of a stream, authenticating ad along with it, and appends it to dst
+func sealChunk(aead cipher.AEAD, prefix []byte, i uint32, last bool, ad []byte, dst []byte, chunk []byte) []byte {
+	return aead.Seal(dst, streamNonce(prefix, i, last), chunk, ad)
+}
+
+// openChunk opens chunk i of a stream, checking ad along with it, and appends it to dst
+func openChunk(aead cipher.AEAD, prefix []byte, i uint32, last bool, ad []byte, dst []byte, chunk []byte) ([]byte,
+	error) {
+	opened, err := aead.Open(dst, streamNonce(prefix, i, last), chunk, ad)
+	if err != nil {
+		return nil, authError{err}
+	}
+	return opened, nil
+}
+
+// pieceReader is an io.Reader over the pieces returned by next, which returns io.EOF at the end
+type pieceReader struct {
+	next func() ([]byte, error)
+	buf  []byte
+	// pieces of a secret are wiped once they've been read
+	secret bool
+	piece  []byte
+}
+
+func (p *pieceReader) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.secret {
+			wipe(p.piece)
+		}
+
+		var err error
+		p.buf, err = p.next()
+		if err != nil {
+			return 0, err
+		}
+		p.piece = p.buf
+	}
+
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// newSealReader returns a reader of the sealed stream of the length bytes of plaintext in r
+func newSealReader(aead cipher.AEAD, r io.Reader, length int64) (io.Reader, error) {
+	if streamChunks(length) > 1<<32 {
+		return nil, errStreamTooLong
+	}
+
+	prefix := make([]byte, prefixSize(aead))
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	chunk := make([]byte, streamChunk)
+	sealed := make([]byte, 0, streamChunk+tagSize)
+	left := length
+	done := false
+	var i uint32
+	return &pieceReader{buf: prefix, next: func() ([]byte, error) {
+		if done {
+			return nil, io.EOF
+		}
+
+		n := int64(streamChunk)
+		if left < n {
+			n = left
+		}
+		if _, err := io.ReadFull(r, chunk[:n]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		left -= n
+		done = left == 0
+		sealed = sealChunk(aead, prefix, i, done, nil, sealed[:0], chunk[:n])
+		i++
+		return sealed, nil
+	}}, nil
+}
+
+// newOpenReader returns a reader of the length bytes of plaintext sealed in the stream r. Every chunk is checked along
+// with ad, but the last, which is checked along with lastAD.
+func newOpenReader(aead cipher.AEAD, r io.Reader, length int64, ad []byte, lastAD []byte) io.Reader {
+	var prefix []byte
+	chunk := make([]byte, streamChunk+tagSize)
+	plaintext := make([]byte, 0, streamChunk)
+	left := length
+	done := false
+	var i uint32
+	return &pieceReader{secret: true, next: func() ([]byte, error) {
+		if done {
+			return nil, io.EOF
+		}
+		if prefix == nil {
+			prefix = make([]byte, prefixSize(aead))
+			if _, err := io.ReadFull(r, prefix); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		}
+
+		n := int64(streamChunk)
+		if left < n {
+			n = left
+		}
+		if _, err := io.ReadFull(r, chunk[:n+tagSize]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		left -= n
+		done = left == 0
+		chunkAD := ad
+		if done {
+			chunkAD = lastAD
+		}
+		var err error
+		plaintext, err = openChunk(aead, prefix, i, done, chunkAD, plaintext[:0], chunk[:n+tagSize])
+		if err != nil {
+			return nil, err
+		}
+		i++
+		return plaintext, nil
+	}}
+}
+
+// sealWriter seals everything written to it as one stream, whose length isn't known until it's closed
+type sealWriter struct {
+	aead   cipher.AEAD
+	w      io.Writer
+	ad     []byte
+	prefix []byte
+	i      int64
+	buf    []byte
+	sealed []byte
+}
+
+// newSealWriter returns a writer that seals a stream to w, starting with its nonce prefix. Every chunk but the last
+// authenticates ad along with it.
+func newSealWriter(aead cipher.AEAD, w io.Writer, ad []byte) (*sealWriter, error) {
+	prefix := make([]byte, prefixSize(aead))
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &sealWriter{aead: aead, w: w, ad: ad, prefix: prefix}, nil
+}
+
+// Write seals every whole chunk but the last, which has to wait to see whether more is written
+func (s *sealWriter) Write(b []byte) (int, error) {
+	s.buf = append(s.buf, b...)
+	for len(s.buf) > streamChunk {
+		if err := s.seal(s.buf[:streamChunk], false, s.ad); err != nil {
+			return 0, err
+		}
+		s.buf = append(s.buf[:0], s.buf[streamChunk:]...)
+	}
+	return len(b), nil
+}
+
+// close seals the last chunk, authenticating lastAD along with it, without closing w, and wipes what was written
+func (s *sealWriter) close(lastAD []byte) error {
+	err := s.seal(s.buf, true, lastAD)
+	wipe(s.buf[:cap(s.buf)])
+	return err
+}
+
+func (s *sealWriter) seal(chunk []byte, last bool, ad []byte) error {
+	if s.i >= 1<<32 {
+		return errStreamTooLong
+	}
+	s.sealed = sealChunk(s.aead, s.prefix, uint32(s.i), last, ad, s.sealed[:0], chunk)
+	s.i++
+	_, err := s.w.Write(s.sealed)
+	return err
+}
+
+// sealStream seals the length bytes of plaintext in r, and writes the stream to w. A negative length seals all of r.
+// Chunks are sealed in parallel.
+func sealStream(aead cipher.AEAD, ad []byte, r io.Reader, w io.Writer, length int64) error {
+	if length >= 0 && streamChunks(length) > 1<<32 {
+		return errStreamTooLong
+	}
+
+	prefix := make([]byte, prefixSize(aead))
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+
+	return parallelChunks(r, w, streamChunk, length, func(i uint32, last bool, chunk []byte) ([]byte, error) {
+		return sealChunk(aead, prefix, i, last, ad, chunk[:0:0], chunk), nil
+	})
+}
+
+// openStream opens the stream of length bytes of plaintext in r, and writes the plaintext to w. A negative length
+// opens all of r. Chunks are opened in parallel.
+func openStream(aead cipher.AEAD, ad []byte, r io.Reader, w io.Writer, length int64) error {
+	prefix := make([]byte, prefixSize(aead))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	sealed := int64(-1)
+	if length >= 0 {
+		sealed = sealedLength(aead, length) - int64(len(prefix))
+	}
+	err := parallelChunks(r, w, streamChunk+tagSize, sealed, func(i uint32, last bool, chunk []byte) ([]byte, error) {
+		return openChunk(aead, prefix, i, last, ad, chunk[:0], chunk)
+	})
+	if err != nil {
+		return err
+	}
+
+	// anything after the last chunk was never sealed
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return errTrailingData
+	}
+	return nil
+}
+
+// chunkJob is a chunk of a stream waiting to be sealed or opened
+type chunkJob struct {
+	i    uint32
+	last bool
+	data []byte
+	out  chan chunkResult
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// parallelChunks cuts the length bytes in r into chunks of size, runs work on them across a pool of GOMAXPROCS
+// workers, and writes the results to w in order. A negative length reads until the end of r. Only a few chunks per
+// worker are held in memory at once.
+func parallelChunks(r io.Reader, w io.Writer, size int, length int64,
+	work func(i uint32, last bool, chunk []byte) ([]byte, error)) error {
+	workers := runtime.GOMAXPROCS(0)
+	jobs := make(chan *chunkJob, workers)
+	order := make(chan *chunkJob, 2*workers)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		chunks := newChunkReader(r, size, length)
+		for last := false; !last; {
+			job := &chunkJob{out: make(chan chunkResult, 1)}
+			var err error
+			job.i, job.data, job.last, err = chunks.next()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			last = job.last
+
+			select {
+			case order <- job:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < workers; n++ {
+		go func() {
+			for job := range jobs {
+				data, err := work(job.i, job.last, job.data)
+				job.out <- chunkResult{data, err}
+			}
+		}()
+	}
+
+	for job := range order {
+		result := <-job.out
+		if result.err != nil {
+			return result.err
+		}
+		if _, err := w.Write(result.data); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// chunkReader cuts a stream into chunks, and knows which chunk is the last
+type chunkReader struct {
+	r      io.Reader
+	ahead  *bufio.Reader
+	size   int
+	length int64
+	i      int64
+}
+
+// newChunkReader cuts the length bytes of r into chunks of size. A negative length reads until the end of r, which
+// is found by looking ahead after each chunk. Otherwise nothing past length is read from r.
+func newChunkReader(r io.Reader, size int, length int64) *chunkReader {
+	c := &chunkReader{r: r, size: size, length: length}
+	if length < 0 {
+		c.ahead = bufio.NewReaderSize(r, size)
+		c.r = c.ahead
+	}
+	return c
+}
+
+// next returns the next chunk and its number, and whether it's the last one
+func (c *chunkReader) next() (uint32, []byte, bool, error) {
+	if c.i >= 1<<32 {
+		return 0, nil, false, errStreamTooLong
+	}
+	i := c.i
+	c.i++
+
+	if c.length >= 0 {
+		n := c.length - i*int64(c.size)
+		if n > int64(c.size) {
+			n = int64(c.size)
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(c.r, chunk); err != nil {
+			return 0, nil, false, unexpectedEOF(err)
+		}
+		return uint32(i), chunk, c.length-i*int64(c.size) <= int64(c.size), nil
+	}
+
+	chunk := make([]byte, c.size)
+	n, err := io.ReadFull(c.r, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return uint32(i), chunk[:n], true, nil
+	} else if err != nil {
+		return 0, nil, false, err
+	}
+
+	_, err = c.ahead.Peek(1)
+	if err != nil && err != io.EOF {
+		return 0, nil, false, err
+	}
+	return uint32(i), chunk, err == io.EOF, nil
+}
+
+// lengthReader reads exactly left bytes from r, ignoring anything after them
+type lengthReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *lengthReader) Read(b []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > l.left {
+		b = b[:l.left]
+	}
+
+	n, err := l.r.Read(b)
+	l.left -= int64(n)
+	if err == io.EOF && l.left > 0 {
+		return n, errTruncated
+	}
+	return n, err
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for streams that end before their recorded length
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,318 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// digestKeySize is the length of the random key that a set's digest is keyed with
+const digestKeySize = 32
+
+var (
+	errDigestMismatch = errors.New("the shards don't combine to the secret they were split from")
+	errNoDigest       = errors.New("these shards were written before shush recorded a digest of the secret; " +
+		"reshare the set to add one")
+)
+
+// Every set records an HMAC of its secret, so that combining the set can be checked without knowing the secret
+// beforehand. The HMAC is keyed with a random key that's shared ahead of the secret, so the digest can only be checked
+// once the set has been combined, and can't be used to confirm a guess at the secret without a threshold of shards.
+
+// digestSet gives every header in a new set room for the digest of the secret, and returns the key to share ahead of
+// the secret, which has to be released, and the hash that the secret is written to as it's split
+func digestSet(headers []*shardHeader) (*secureBuffer, hash.Hash, error) {
+	key := newSecureBuffer(digestKeySize)
+	if _, err := rand.Read(key.bytes()); err != nil {
+		key.release()
+		return nil, nil, err
+	}
+
+	digest := hmac.New(sha256.New, key.bytes())
+	for _, h := range headers {
+		h.Digest = make([]byte, digest.Size())
+	}
+	return key, digest, nil
+}
+
+// digestPrefix returns the length of the digest key that shards with this header share ahead of the secret
+func digestPrefix(header *shardHeader) int64 {
+	if header == nil || len(header.Digest) == 0 {
+		return 0
+	}
+	return digestKeySize
+}
+
+// digestReader reads the length bytes of a secret, and fails on the last of them if it doesn't match the digest
+type digestReader struct {
+	r      io.Reader
+	digest hash.Hash
+	want   []byte
+	left   int64
+}
+
+// checkDigest reads the digest key at the start of r, if the set has a digest, and returns a reader of the secret
+// that follows it, which checks the secret against the digest in header
+func checkDigest(header *shardHeader, r io.Reader, length int64) (io.Reader, error) {
+	if digestPrefix(header) == 0 {
+		return r, nil
+	}
+
+	key := newSecureBuffer(digestKeySize)
+	defer key.release()
+	if _, err := io.ReadFull(r, key.bytes()); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return &digestReader{r: r, digest: hmac.New(sha256.New, key.bytes()), want: header.Digest, left: length}, nil
+}
+
+func (d *digestReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	d.digest.Write(b[:n])
+	d.left -= int64(n)
+
+	// whatever reads the secret may stop at its length, so the check can't wait for io.EOF
+	if n > 0 && d.left == 0 && !hmac.Equal(d.digest.Sum(nil), d.want) {
+		return n, errDigestMismatch
+	}
+	return n, err
+}
+
+// Verify checks that src decrypts with the key in keyFile, by opening every chunk, without writing any of the
+// plaintext
+func Verify(keyFile string, src string) error {
+	master, err := readKey(keyFile)
+	if err != nil {
+		return err
+	}
+	defer master.release()
+
+	if err := verifyEncrypted(master.bytes(), src); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully verified %s\n", src)
+	return nil
+}
+
+// verifyEncrypted opens every chunk of src with the master key, and throws the plaintext away
+func verifyEncrypted(master []byte, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r := bufio.NewReader(in)
+	header, ad, err := readEncryptHeader(r)
+	if err != nil {
+		return err
+	}
+
+	if header == nil {
+		if _, err := openLegacy(master, r); err != nil {
+			return damaged(src, err)
+		}
+	} else {
+		aead, err := fileCipher(master, header)
+		if err != nil {
+			return err
+		}
+		if _, err := openMetadata(master, header); err != nil {
+			return err
+		}
+
+		err = openPlaintext(aead, ad, r, header, func(plaintext io.Reader) error {
+			_, err := io.Copy(ioutil.Discard, plaintext)
+			return err
+		})
+		if err != nil {
+			return damaged(src, err)
+		}
+	}
+	return nil
+}
+
+// VerifySet checks that the shards in files combine to the secret they were split from, without writing it anywhere.
+// Beyond a threshold, the shards are combined again until each of them has been part of a combination.
+func VerifySet(files []string) error {
+	// only the headers are needed to plan the combinations, so protected shards aren't unlocked yet
+	shards := make([]*shard, len(files))
+	for i, f := range files {
+		s, err := openShard(f)
+		if err != nil {
+			return err
+		}
+		s.close()
+		shards[i] = s
+	}
+
+	var unchecked []string
+	var err error
+	if h := shards[0].header; h != nil && h.Policy != nil {
+		unchecked, err = verifyPolicySet(files, shards)
+	} else {
+		err = verifyRotations(files, shards)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Successfully verified shards:")
+	skipped := map[string]bool{}
+	for _, f := range unchecked {
+		skipped[f] = true
+	}
+	for _, f := range files {
+		if !skipped[f] {
+			fmt.Println(" ", f)
+		}
+	}
+	fmt.Print("\n")
+
+	if len(unchecked) > 0 {
+		fmt.Println("These shards hold shares that no combination of the shards given needs, so they weren't checked:")
+		for _, f := range unchecked {
+			fmt.Println(" ", f)
+		}
+		fmt.Print("\n")
+	}
+	return nil
+}
+
+// verifyRotations combines the shards starting from each one that hasn't been part of a combination yet. Sets
+// without a policy use the first threshold of shares.
+func verifyRotations(files []string, shards []*shard) error {
+	checked := make([]bool, len(files))
+	for first := range files {
+		if checked[first] {
+			continue
+		}
+
+		// start with the first shard that hasn't been checked, and wrap around
+		order := append(append([]string{}, files[first:]...), files[:first]...)
+		if err := verifyShards(order); err != nil {
+			return err
+		}
+
+		threshold := shards[first].header.Threshold
+		for i, shares := 0, 0; shares < threshold && i < len(files); i++ {
+			j := (first + i) % len(files)
+			checked[j] = true
+			shares += shards[j].weight
+		}
+	}
+	return nil
+}
+
+// verifyPolicySet combines the shards of a policy set until every share has been used, and returns the shards with
+// shares that couldn't be. A policy only uses the shares it needs, in the order of the policy rather than of the
+// shards, so each combination leaves out as many of the shards that were already checked as it can.
+func verifyPolicySet(files []string, shards []*shard) ([]string, error) {
+	if policyShares(shards) == nil {
+		// combining them explains why not
+		return nil, verifyShards(files)
+	}
+
+	checked := map[string]bool{}
+	skipped := map[string]bool{}
+	for t, s := range shards {
+		for _, path := range s.header.Paths {
+			share := pathKey(path)
+			if checked[share] {
+				continue
+			}
+
+			// drop every other shard that we can, the ones we've checked first
+			keep := make([]bool, len(shards))
+			for i := range keep {
+				keep[i] = true
+			}
+			for _, done := range []bool{true, false} {
+				for i := range shards {
+					if i == t || shardChecked(shards[i], checked) != done {
+						continue
+					}
+					keep[i] = false
+					if policyShares(keptShards(shards, keep)) == nil {
+						keep[i] = true
+					}
+				}
+			}
+
+			used := policyShares(keptShards(shards, keep))
+			if !used[share] {
+				skipped[files[t]] = true
+				continue
+			}
+			var subset []string
+			for i, f := range files {
+				if keep[i] {
+					subset = append(subset, f)
+				}
+			}
+			if err := verifyShards(subset); err != nil {
+				return nil, err
+			}
+			for path := range used {
+				checked[path] = true
+			}
+		}
+	}
+
+	var unchecked []string
+	for i, f := range files {
+		if skipped[f] && !shardChecked(shards[i], checked) {
+			unchecked = append(unchecked, f)
+		}
+	}
+	return unchecked, nil
+}
+
+// shardChecked returns whether every share in the shard has been checked
+func shardChecked(s *shard, checked map[string]bool) bool {
+	for _, path := range s.header.Paths {
+		if !checked[pathKey(path)] {
+			return false
+		}
+	}
+	return true
+}
+
+// keptShards returns the shards that keep says to keep
+func keptShards(shards []*shard, keep []bool) []*shard {
+	var kept []*shard
+	for i, s := range shards {
+		if keep[i] {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// verifyShards combines the shards in files, and reads the whole secret to check its digest
+func verifyShards(files []string) error {
+	shards, err := openShards(files)
+	if err != nil {
+		return err
+	}
+	defer closeShards(shards)
+
+	if h := shards[0].header; h == nil || len(h.Digest) == 0 {
+		return errNoDigest
+	}
+
+	secret, _, err := combineShards(files, shards)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, secret)
+	return err
+}
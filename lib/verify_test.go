@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// corrupt flips the last bit of the file at path
+func corrupt(t *testing.T, path string) {
+	t.Helper()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[len(contents)-1] ^= 1
+	err = ioutil.WriteFile(path, contents, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Gen("new.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Encrypt("test.key", "data.txt", EncryptOptions{Compression: "zstd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data.txt")
+
+	err = Verify("test.key", "data.txt.shush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("data.txt"); !os.IsNotExist(err) {
+		t.Fatal("verifying wrote the plaintext")
+	}
+
+	err = Verify("new.key", "data.txt.shush")
+	if err == nil {
+		t.Fatal("verified with the wrong key")
+	}
+
+	corrupt(t, "data.txt.shush")
+	err = Verify("test.key", "data.txt.shush")
+	if err == nil {
+		t.Fatal("verified a damaged file")
+	}
+}
+
+func TestVerifySet(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := Gen("test.key", GenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := []string{"test.key.shard0", "test.key.shard1", "test.key.shard2", "test.key.shard3", "test.key.shard4"}
+	for _, opts := range []SplitOptions{{}, {Compact: true}, {Field: "gf65536"}} {
+		deleteTestFiles()
+		Gen("test.key", GenOptions{})
+
+		err = Split("test.key", 5, 3, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove("test.key")
+
+		err = VerifySet(shards)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat("test.key"); !os.IsNotExist(err) {
+			t.Fatal("verifying wrote the secret")
+		}
+
+		// shard4 is only used once the first threshold has been checked
+		corrupt(t, "test.key.shard4")
+		err = VerifySet(shards)
+		if err == nil {
+			t.Fatalf("%+v: verified a set with a damaged shard", opts)
+		}
+
+		// merging checks the digest too, and leaves nothing behind
+		err = Merge([]string{"test.key.shard4", "test.key.shard0", "test.key.shard1"})
+		if err == nil {
+			t.Fatalf("%+v: merged a damaged shard", opts)
+		}
+		if _, err := os.Stat("test.key"); !os.IsNotExist(err) {
+			t.Fatal("a damaged secret was left behind")
+		}
+	}
+
+	// a policy set uses whichever shards it needs
+	deleteTestFiles()
+	Gen("test.key", GenOptions{})
+	err = ioutil.WriteFile("policy.json", []byte(testPolicy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy("policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Split("test.key", 0, 0, SplitOptions{Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifySet([]string{"test.key.shard-alice", "test.key.shard-bob", "test.key.shard-judy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shares beyond what a policy needs are checked too
+	deleteTestFiles()
+	Gen("test.key", GenOptions{})
+	policy, err = ParsePolicy("2 of alice, bob, carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Split("test.key", 0, 0, SplitOptions{Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards = []string{"test.key.shard-alice", "test.key.shard-bob", "test.key.shard-carol"}
+	err = VerifySet(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, "test.key.shard-carol")
+	err = VerifySet(shards)
+	if err != errDigestMismatch {
+		t.Fatal("expected the damaged shard beyond the threshold to be found, got", err)
+	}
+
+	// shards from before digests can't be verified
+	deleteTestFiles()
+	for name, contents := range legacyShards {
+		err := ioutil.WriteFile(name, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = VerifySet([]string{"test.key.shard0", "test.key.shard1"})
+	if err != errNoDigest {
+		t.Fatal("expected shards without a digest, got", err)
+	}
+}
+
+func TestDigestKey(t *testing.T) {
+	t.Cleanup(deleteTestFiles)
+	deleteTestFiles()
+
+	err := ioutil.WriteFile("data.txt", []byte(testData), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Split("data.txt", 3, 2, SplitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the digest is in the header, and its key is shared, so a shard alone can't confirm a guess at the secret
+	contents, err := ioutil.ReadFile("data.txt.shard0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.IndexByte(contents, '\n')
+	if bytes.Contains(contents[:i], []byte(`"salt"`)) {
+		t.Fatal("the digest key was written in the clear")
+	}
+
+	// a damaged share of the digest key is caught like any other
+	contents[i+1] ^= 1
+	err = ioutil.WriteFile("data.txt.shard0", contents, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifySet([]string{"data.txt.shard0", "data.txt.shard1"})
+	if err != errDigestMismatch {
+		t.Fatal("expected a damaged digest key to be caught, got", err)
+	}
+}
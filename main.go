@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	lib "github.com/shushcli/shush/lib"
 )
@@ -15,21 +18,63 @@ var (
 
 	// gen errors
 	errMissingKeyFile = errors.New("missing name for key file")
+	errExtraGenArgs   = func(args []string) error {
+		return fmt.Errorf("unexpected arguments after the key file: %s; flags go before it",
+			strings.Join(args, " "))
+	}
 
 	// split errors
 	errInvalidShardCount = errors.New("invalid number of shards")
 	errInvalidThreshold  = errors.New("invalid threshold provided")
 	errMissingPath       = errors.New("missing file path of the secret")
+	errPolicyFlags       = errors.New("a policy can't be combined with -t, -s or -holders")
 
 	// encrypt/decrypt errors
 	errEncryptMissingFileArg = errors.New("missing the filename to encrypt")
 	errDecryptMissingFileArg = errors.New("missing the filename to decrypt")
+	errInvalidParity         = errors.New("invalid parity; expected a percentage from 1% to 100%")
+	errInvalidRange          = errors.New("invalid range; expected offset:length, like 1024:512")
+
+	// repair errors
+	errRepairMissingFileArg = errors.New("missing the filename to repair")
+
+	// verify errors
+	errVerifyMissingFileArg = errors.New("missing the filename to verify")
+
+	// inspect errors
+	errInspectMissingFileArg = errors.New("missing the filename to inspect")
 )
 
+var fieldUsage = fmt.Sprintf("Field: Which finite field to use, one of %s. gf256 allows up to 255 shards, gf65536 "+
+	"allows up to 65535", strings.Join(lib.Fields, ", "))
+
+var holdersUsage = "Holders: Name each shard after its holder, and give some holders more weight, like " +
+	"cto:3,cfo:2,eng1,eng2 (replaces -s)"
+
+var policyUsage = "Policy: Path to a policy like \"(alice AND bob) OR (2 of carol, dave, erin)\", or a json policy " +
+	"with groups of holders (replaces -t, -s and -holders)"
+
+var compactUsage = "Compact: Encrypt the file with a random key and spread it over the shards, so each shard is " +
+	"about 1/threshold the size of the file"
+
+var protectUsage = "Protect: Ask each holder in turn for a passphrase to seal their shard with, which merge asks " +
+	"them for again"
+
+var cipherUsage = fmt.Sprintf("Cipher: Which cipher to encrypt with, one of %s. xchacha20poly1305 is faster "+
+	"without AES hardware", strings.Join(lib.Ciphers, ", "))
+
+var compressUsage = fmt.Sprintf("Compress: Compress the file before encrypting it, with one of %s. decrypt "+
+	"decompresses it again",
+	strings.Join(lib.Compressions, ", "))
+
 // these are global so that we can see if they got parsed in our error handler
+var genCmd = flag.NewFlagSet("gen", flag.ExitOnError)
 var splitCmd = flag.NewFlagSet("split", flag.ExitOnError)
+var reshareCmd = flag.NewFlagSet("reshare", flag.ExitOnError)
 var encryptCmd = flag.NewFlagSet("encrypt", flag.ExitOnError)
 var decryptCmd = flag.NewFlagSet("decrypt", flag.ExitOnError)
+var verifyCmd = flag.NewFlagSet("verify", flag.ExitOnError)
+var drillCmd = flag.NewFlagSet("drill", flag.ExitOnError)
 
 func main() {
 	err := parseAndRun()
@@ -38,15 +83,27 @@ func main() {
 		fmt.Printf("Error: %s\n\n", err)
 
 		// print flags for relevant sub-command
-		if splitCmd.Parsed() {
+		if genCmd.Parsed() {
+			fmt.Println("gen flags:")
+			genCmd.PrintDefaults()
+		} else if splitCmd.Parsed() {
 			fmt.Println("key split flags:")
 			splitCmd.PrintDefaults()
+		} else if reshareCmd.Parsed() {
+			fmt.Println("reshare flags:")
+			reshareCmd.PrintDefaults()
 		} else if encryptCmd.Parsed() {
 			fmt.Println("encrypt flags:")
 			encryptCmd.PrintDefaults()
 		} else if decryptCmd.Parsed() {
 			fmt.Println("decrypt flags:")
 			decryptCmd.PrintDefaults()
+		} else if verifyCmd.Parsed() {
+			fmt.Println("verify flags:")
+			verifyCmd.PrintDefaults()
+		} else if drillCmd.Parsed() {
+			fmt.Println("drill flags:")
+			drillCmd.PrintDefaults()
 		}
 
 		usage()
@@ -72,10 +129,24 @@ func parseAndRun() error {
 		return handleSplit()
 	case "merge":
 		return handleMerge()
+	case "reshare":
+		return handleReshare()
+	case "extend":
+		return handleExtend()
 	case "encrypt":
 		return handleEncrypt()
 	case "decrypt":
 		return handleDecrypt()
+	case "repair":
+		return handleRepair()
+	case "verify":
+		return handleVerify()
+	case "verify-set":
+		return handleVerifySet()
+	case "drill":
+		return handleDrill()
+	case "inspect":
+		return handleInspect()
 	default:
 		return errMissingSubCommand
 	}
@@ -83,30 +154,46 @@ func parseAndRun() error {
 
 // Our handlers verify that the flags and args exist, but all actual filesystem checking happens in `lib`
 func handleGen() error {
-	if len(os.Args) < 3 {
+	label := genCmd.String("label", "", "Label: A note to record in the key file, like what the key protects")
+	protect := genCmd.Bool("protect", false, "Protect: Seal the key with a passphrase, which is asked for whenever "+
+		"the key is used")
+	genCmd.Parse(os.Args[2:])
+
+	args := genCmd.Args()
+	if len(args) < 1 {
 		return errMissingKeyFile
 	}
+	if len(args) > 1 {
+		return errExtraGenArgs(args[1:])
+	}
 
-	return lib.Gen(os.Args[2])
+	return lib.Gen(args[0], lib.GenOptions{Label: *label, Protect: *protect})
 }
 
 func handleSplit() error {
 	threshold := splitCmd.Int("t", 0, "Threshold: How many shards are needed to reconstruct the messsage?")
 	shardCount := splitCmd.Int("s", 0, "Shards: How many total shards will we generate")
+	field := splitCmd.String("field", "gf256", fieldUsage)
+	holders := splitCmd.String("holders", "", holdersUsage)
+	policy := splitCmd.String("policy", "", policyUsage)
+	compact := splitCmd.Bool("compact", false, compactUsage)
+	protect := splitCmd.Bool("protect", false, protectUsage)
 	splitCmd.Parse(os.Args[2:])
 
-	if *shardCount < 2 {
-		return errInvalidShardCount
-	} else if *threshold > *shardCount || *threshold < 2 {
-		return errInvalidThreshold
+	opts, err := splitOptions(shardCount, *threshold, *field, *holders, *policy)
+	if err != nil {
+		return err
 	}
 
+	opts.Compact = *compact
+	opts.Protect = *protect
+
 	args := splitCmd.Args()
 	if len(args) < 1 {
 		return errMissingPath
 	}
 
-	err := lib.Split(args[0], *shardCount, *threshold)
+	err = lib.Split(args[0], *shardCount, *threshold, opts)
 	if err != nil {
 		return err
 	}
@@ -126,34 +213,236 @@ func handleMerge() error {
 	return nil
 }
 
+func handleReshare() error {
+	threshold := reshareCmd.Int("t", 0, "Threshold: How many of the new shards are needed to reconstruct the messsage?")
+	shardCount := reshareCmd.Int("s", 0, "Shards: How many total shards will we generate for the new set")
+	out := reshareCmd.String("o", "", "Output: Base name for the new shards (defaults to the name of the original file)")
+	field := reshareCmd.String("field", "gf256", fieldUsage)
+	holders := reshareCmd.String("holders", "", holdersUsage)
+	policy := reshareCmd.String("policy", "", policyUsage)
+	compact := reshareCmd.Bool("compact", false, compactUsage)
+	protect := reshareCmd.Bool("protect", false, protectUsage)
+	reshareCmd.Parse(os.Args[2:])
+
+	opts, err := splitOptions(shardCount, *threshold, *field, *holders, *policy)
+	if err != nil {
+		return err
+	}
+
+	opts.Compact = *compact
+	opts.Protect = *protect
+
+	args := reshareCmd.Args()
+	if len(args) < 1 {
+		return errMissingShards
+	}
+
+	return lib.Reshare(args, *out, *shardCount, *threshold, opts)
+}
+
+// splitOptions checks the flags shared by split and reshare. With holders, the shard count is the sum of their weights,
+// and a policy replaces the shard count and threshold altogether.
+func splitOptions(shardCount *int, threshold int, field string, holders string, policy string) (opts lib.SplitOptions,
+	err error) {
+	opts.Field = field
+
+	if policy != "" {
+		if *shardCount != 0 || threshold != 0 || holders != "" {
+			return opts, errPolicyFlags
+		}
+
+		opts.Policy, err = lib.LoadPolicy(policy)
+		return opts, err
+	}
+
+	if holders != "" {
+		opts.Holders, err = lib.ParseHolders(holders)
+		if err != nil {
+			return opts, err
+		}
+
+		*shardCount = 0
+		for _, h := range opts.Holders {
+			*shardCount += h.Weight
+		}
+	}
+
+	if *shardCount < 2 {
+		return opts, errInvalidShardCount
+	} else if threshold > *shardCount || threshold < 2 {
+		return opts, errInvalidThreshold
+	}
+
+	return opts, nil
+}
+
+func handleExtend() error {
+	if len(os.Args) < 3 {
+		return errMissingShards
+	}
+
+	return lib.Extend(os.Args[2:])
+}
+
 func handleEncrypt() error {
 	keyFile := encryptCmd.String("key", "", "Key: Path to your key file")
+	parity := encryptCmd.String("parity", "", "Parity: Also write a parity file this size, like 20%, for repairing damage")
+	cipher := encryptCmd.String("cipher", lib.Ciphers[0], cipherUsage)
+	compress := encryptCmd.String("compress", "", compressUsage)
+	recursive := encryptCmd.Bool("r", false, "Recursive: Archive a whole directory and encrypt the archive, without "+
+		"writing it to disk")
 	encryptCmd.Parse(os.Args[2:])
 
 	if *keyFile == "" {
 		return errMissingKeyFile
 	}
 
-	if len(os.Args) < 4 {
+	args := encryptCmd.Args()
+	if len(args) < 1 {
 		return errEncryptMissingFileArg
 	}
 
-	return lib.Encrypt(*keyFile, os.Args[3])
+	opts := lib.EncryptOptions{Cipher: *cipher, Compression: *compress}
+	if *parity != "" {
+		percent, err := strconv.Atoi(strings.TrimSuffix(*parity, "%"))
+		if err != nil || percent < 1 || percent > 100 {
+			return errInvalidParity
+		}
+		opts.Parity = percent
+	}
+
+	if *recursive {
+		return lib.EncryptDir(*keyFile, args[0], opts)
+	}
+	return lib.Encrypt(*keyFile, args[0], opts)
 }
 
 func handleDecrypt() error {
 	keyFile := decryptCmd.String("key", "", "Key: Path to your key file")
+	byteRange := decryptCmd.String("range", "", "Range: Only decrypt length bytes from offset, like 1024:512, and "+
+		"write them to stdout")
+	ignoreMetadata := decryptCmd.Bool("ignore-metadata", false, "Ignore Metadata: Decrypt to the file's name without "+
+		".shush, instead of restoring its original name, permissions and modification time")
+	extract := decryptCmd.Bool("extract", false, "Extract: Unpack a directory encrypted with -r, instead of writing "+
+		"out its archive")
 	decryptCmd.Parse(os.Args[2:])
 
 	if *keyFile == "" {
 		return errMissingKeyFile
 	}
 
-	if len(os.Args) < 4 {
+	args := decryptCmd.Args()
+	if len(args) < 1 {
 		return errDecryptMissingFileArg
 	}
 
-	return lib.Decrypt(*keyFile, os.Args[3])
+	if *byteRange != "" {
+		parts := strings.Split(*byteRange, ":")
+		if len(parts) != 2 {
+			return errInvalidRange
+		}
+		offset, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || offset < 0 {
+			return errInvalidRange
+		}
+		length, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || length < 0 {
+			return errInvalidRange
+		}
+
+		return lib.DecryptRange(*keyFile, args[0], offset, length, os.Stdout)
+	}
+
+	return lib.Decrypt(*keyFile, args[0], lib.DecryptOptions{IgnoreMetadata: *ignoreMetadata, Extract: *extract})
+}
+
+func handleRepair() error {
+	if len(os.Args) < 3 {
+		return errRepairMissingFileArg
+	}
+
+	return lib.Repair(os.Args[2])
+}
+
+func handleVerify() error {
+	keyFile := verifyCmd.String("key", "", "Key: Path to your key file")
+	verifyCmd.Parse(os.Args[2:])
+
+	if *keyFile == "" {
+		return errMissingKeyFile
+	}
+
+	args := verifyCmd.Args()
+	if len(args) < 1 {
+		return errVerifyMissingFileArg
+	}
+
+	for _, path := range args {
+		if err := lib.Verify(*keyFile, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleVerifySet() error {
+	if len(os.Args) < 3 {
+		return errMissingShards
+	}
+
+	return lib.VerifySet(os.Args[2:])
+}
+
+func handleDrill() error {
+	payload := drillCmd.String("payload", "", "Payload: An encrypted file to test-decrypt with the recovered key")
+	keyID := drillCmd.String("key-id", "", "Key ID: The ID the recovered key should have, like 7F3A-91C2 (defaults "+
+		"to the ID recorded in the shards)")
+	report := drillCmd.String("report", "", "Report: Where to write the signed report (defaults to "+
+		"shush-drill-<set>-<date>.json)")
+	check := drillCmd.String("check", "", "Check: Check the signature on a report from an earlier drill, instead")
+	signer := drillCmd.String("signer", "", "Signer: With -check, the signing key the report should have, from an "+
+		"earlier drill of the set")
+	against := drillCmd.String("against", "", "Against: With -check, an earlier report for the set, which the report "+
+		"should be signed by the same key as")
+	drillCmd.Parse(os.Args[2:])
+
+	if *check != "" {
+		_, err := lib.CheckReport(*check, lib.CheckOptions{Signer: *signer, Against: *against})
+		return err
+	}
+
+	// without shards on the command line, each holder brings theirs in turn
+	shards := drillCmd.Args()
+	if len(shards) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for {
+			fmt.Printf("Path to the next holder's shard (leave empty when everyone's done): ")
+			if !scanner.Scan() || strings.TrimSpace(scanner.Text()) == "" {
+				break
+			}
+			shards = append(shards, strings.TrimSpace(scanner.Text()))
+		}
+		fmt.Print("\n")
+	}
+	if len(shards) == 0 {
+		return errMissingShards
+	}
+
+	_, err := lib.Drill(lib.DrillOptions{Shards: shards, KeyID: *keyID, Payload: *payload, Report: *report})
+	return err
+}
+
+func handleInspect() error {
+	if len(os.Args) < 3 {
+		return errInspectMissingFileArg
+	}
+
+	for _, path := range os.Args[2:] {
+		if err := lib.Inspect(path); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func usage() {
@@ -163,19 +452,87 @@ USAGE:
 Generate a new AES Key:
 	shush gen my.key
 
+Generate a new key, with a note about what it protects:
+	shush gen -label="family photos" my.key
+
+Generate a new key that's sealed with a passphrase, which is asked for whenever it's used:
+	shush gen -protect my.key
+
 Encrypt a secret with your key:
-	shush encrypt -key=my.key secrets.tar
+	shush encrypt -key=my.key secrets.txt
 
 Split a file into 5 shards, requiring a threshold of at least 3 shards for recovery:
 	shush split -t=3 -s=5 my.key
 
+Split a file into 1000 shards, using a larger field:
+	shush split -t=50 -s=1000 -field=gf65536 my.key
+
+Split a file between named holders, where some holders count for more than one shard:
+	shush split -t=4 -holders=cto:3,cfo:2,eng1,eng2 my.key
+
+Split a file between groups of holders, following a policy:
+	shush split -policy=policy.json my.key
+
+Split a file with a policy written as a rule:
+	echo "(alice AND bob) OR (2 of carol, dave, erin)" > policy.txt
+	shush split -policy=policy.txt my.key
+
+Split a large archive, so that each shard is only about a third of its size:
+	shush split -t=3 -s=5 -compact secrets.tar
+
+Split a key between holders, asking each of them for a passphrase to protect their shard with:
+	shush split -t=2 -holders=alice,bob,carol -protect my.key
+
 Merge shards back into their original file:
 	shush merge my.key.shard0 my.key.shard1 my.key.shard4
 
 Merge shards with a wildcard:
 	shush merge my.key.shard*
 
-Decrypt a secret with your key:
+Change the threshold or shard count of an existing set, without writing the secret to disk:
+	shush reshare -t=4 -s=7 -o=new.key my.key.shard0 my.key.shard1 my.key.shard4
+
+Issue one more shard for an existing set, from a threshold of its shards:
+	shush extend my.key.shard0 my.key.shard1 my.key.shard4
+
+Encrypt a whole directory, without writing an unencrypted archive to disk:
+	shush encrypt -key=my.key -r -compress=zstd ./secrets/
+
+Decrypt and unpack an encrypted directory:
+	shush decrypt -key=my.key -extract secrets.shush
+
+Compress a secret before encrypting it:
+	shush encrypt -key=my.key -compress=zstd dump.sql
+
+Encrypt a secret with XChaCha20-Poly1305 instead of AES-GCM:
+	shush encrypt -key=my.key -cipher=xchacha20poly1305 secrets.tar
+
+Encrypt a secret, and write a parity file for repairing damage later:
+	shush encrypt -key=my.key -parity=20% secrets.tar
+
+Decrypt a secret with your key, restoring its original name, permissions and modification time:
 	shush decrypt -key=my.key secrets.tar.shush
+
+Decrypt just 512 bytes, starting 1024 bytes in:
+	shush decrypt -key=my.key -range=1024:512 secrets.tar.shush > part
+
+Repair damage to an encrypted file, using its parity file:
+	shush repair secrets.tar.shush
+
+Check that an encrypted file decrypts, without writing the plaintext:
+	shush verify -key=my.key secrets.tar.shush
+
+Check that a set of shards combines to the original secret, without writing it:
+	shush verify-set my.key.shard*
+
+Run a recovery drill, recovering the key in memory and test-decrypting a payload, and write a signed report:
+	shush drill -payload=secrets.tar.shush my.key.shard0 my.key.shard1 my.key.shard4
+
+Check a drill report against an earlier one, which should be signed by the same key:
+	shush drill -check=shush-drill-4f1c2a9e0b3d5e7f-2024-03-31.json \
+		-against=shush-drill-4f1c2a9e0b3d5e7f-2023-09-30.json
+
+Find out what a key, shard or encrypted file is, without needing any secret:
+	shush inspect my.key.shard0 secrets.tar.shush
 `)
 }